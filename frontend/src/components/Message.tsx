@@ -1,5 +1,5 @@
 import { useUsers } from "../context/UsersContext";
-import { IMsg } from "../routes/Room";
+import { IAttachment, IMsg } from "../routes/Room";
 import classes from "../styles/pages/Room.module.scss";
 import User from "./User";
 import { baseURL } from "../services/makeRequest";
@@ -7,6 +7,65 @@ import { ImSpinner8 } from "react-icons/im";
 import { AiOutlineDownload } from "react-icons/ai";
 import { BiError } from "react-icons/bi";
 
+function Attachment({
+  attachment,
+  reverse,
+}: {
+  attachment: IAttachment;
+  reverse: boolean;
+}) {
+  if (attachment.status === "pending") {
+    return (
+      <div
+        className={classes.pending}
+        style={reverse ? { flexDirection: "row-reverse" } : {}}
+      >
+        <ImSpinner8 className={classes.spinner} />
+        {attachment.name || "Attachment"} pending
+      </div>
+    );
+  }
+  if (attachment.status === "error") {
+    return (
+      <div className={classes.error}>
+        <BiError />
+        {attachment.name || "Attachment"} failed to upload
+      </div>
+    );
+  }
+  if (!attachment.url) {
+    //links are only sent to members of the room, or they haven't arrived yet
+    return <div>{attachment.name || "Attachment"}</div>;
+  }
+  if (attachment.thumb_url) {
+    return (
+      <a
+        href={`${baseURL}${attachment.view_url || attachment.url}`}
+        target="_blank"
+        rel="noreferrer"
+      >
+        <img
+          src={`${baseURL}${attachment.thumb_url}`}
+          alt={attachment.name}
+          className={classes.imageAttachment}
+        />
+      </a>
+    );
+  }
+  return (
+    <a
+      download={attachment.name}
+      href={`${baseURL}${attachment.url}`}
+      aria-label="Download attachment"
+      className={classes.downloadAttachment}
+      style={reverse ? { flexDirection: "row-reverse" } : {}}
+    >
+      <AiOutlineDownload />
+      {attachment.name || "Download attachment"}
+    </a>
+  );
+}
+
 export default function Message({
   msg,
   reverse,
@@ -38,7 +97,15 @@ export default function Message({
           {msg.content}
         </div>
       </div>
-      {msg.has_attachment && !msg.attachment_pending && (
+      {msg.attachments?.map((attachment) => (
+        <Attachment
+          key={attachment.ID}
+          attachment={attachment}
+          reverse={reverse}
+        />
+      ))}
+      {/* messages from before there could be more than one attachment have it described on the message */}
+      {!msg.attachments && msg.has_attachment && !msg.attachment_pending && (
         <>
           {msg.attachment_type === "image/jpeg" ? (
             <img
@@ -59,13 +126,13 @@ export default function Message({
           )}
         </>
       )}
-      {msg.attachment_error && (
+      {!msg.attachments && msg.attachment_error && (
         <div className={classes.error}>
           <BiError />
           Attachment error
         </div>
       )}
-      {msg.attachment_pending && (
+      {!msg.attachments && msg.attachment_pending && (
         <div
           className={classes.pending}
           style={reverse ? { flexDirection: "row-reverse" } : {}}
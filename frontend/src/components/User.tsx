@@ -73,8 +73,8 @@ export default function User({
         <>
           <span
             style={{
-              ...(user.base64pfp
-                ? { backgroundImage: `url(${user.base64pfp})` }
+              ...(user.pfp_url
+                ? { backgroundImage: `url(${user.pfp_url})` }
                 : {}),
               ...(onClick ? { cursor: "pointer" } : {}),
               ...(light ? { border: "1px solid white" } : {}),
@@ -84,7 +84,7 @@ export default function User({
             }}
             className={classes.pfp}
           >
-            {!user.base64pfp && (
+            {!user.pfp_url && (
               <AiOutlineUser
                 style={light ? { fill: "white" } : {}}
                 className={classes.pfpIcon}
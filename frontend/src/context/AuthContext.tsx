@@ -6,7 +6,8 @@ import { useNavigate } from "react-router-dom";
 export interface IUser {
   ID: string;
   username: string;
-  base64pfp?: string;
+  pfp_url?: string; //changes every time the pfp does, so it can be cached
+  pfp_blurhash?: string;
   token?: string; //used to authenticate ws connection. its the refresh_token cookie
 }
 
@@ -2,7 +2,12 @@ import classes from "../styles/pages/Room.module.scss";
 import { useEffect, useState, useRef, useCallback } from "react";
 import type { ChangeEvent, FormEvent } from "react";
 import { useSocket } from "../context/SocketContext";
-import { joinRoom, leaveRoom, uploadAttachment } from "../services/rooms";
+import {
+  getAttachmentLinks,
+  joinRoom,
+  leaveRoom,
+  uploadAttachment,
+} from "../services/rooms";
 import { useNavigate, useParams } from "react-router-dom";
 import ResMsg, { IResMsg } from "../components/ResMsg";
 import { useAuth } from "../context/AuthContext";
@@ -15,6 +20,21 @@ import IconBtn from "../components/IconBtn";
 import { IoSend } from "react-icons/io5";
 import { AiFillFile } from "react-icons/ai";
 
+export interface IAttachment {
+  ID: string;
+  name: string;
+  size: number;
+  mime_type: string;
+  width?: number;
+  height?: number;
+  blurhash?: string;
+  status: "pending" | "complete" | "error";
+  // signed links, only sent to members of the room
+  url?: string;
+  view_url?: string;
+  thumb_url?: string;
+}
+
 export interface IMsg {
   content: string;
   uid: string;
@@ -24,6 +44,8 @@ export interface IMsg {
   attachment_pending: boolean;
   attachment_type?: string;
   attachment_error?: boolean;
+  // messages from before there could be more than one attachment have no list
+  attachments?: IAttachment[];
 }
 
 export default function Room() {
@@ -97,6 +119,24 @@ export default function Room() {
     };
   }, [id]);
 
+  const updateAttachment = (
+    msgId: string,
+    attachmentId: string,
+    fields: Partial<IAttachment>
+  ) =>
+    setMessages((old) => {
+      let newMsgs = old;
+      const i = old.findIndex((m) => m.ID === msgId);
+      if (i === -1 || !newMsgs[i].attachments) return old;
+      newMsgs[i].attachments = newMsgs[i].attachments!.map((a) =>
+        a.ID === attachmentId ? { ...a, ...fields } : a
+      );
+      newMsgs[i].attachment_pending = newMsgs[i].attachments!.some(
+        (a) => a.status === "pending"
+      );
+      return [...newMsgs];
+    });
+
   const messageListener = useCallback(
     (e: any) => {
       let data = JSON.parse(e.data);
@@ -132,15 +172,44 @@ export default function Room() {
             pen: false,
           });
         }
+        if (data.event_type === "attachment_added") {
+          setMessages((old) => {
+            let newMsgs = old;
+            const i = old.findIndex((m) => m.ID === data.ID);
+            if (i === -1) return old;
+            newMsgs[i].attachments = [
+              ...(newMsgs[i].attachments || []),
+              data.attachment,
+            ];
+            newMsgs[i].attachment_pending = true;
+            return [...newMsgs];
+          });
+        }
         if (data.event_type === "attachment_complete") {
+          updateAttachment(data.ID, data.attachment.ID, data.attachment);
           setMessages((old) => {
             let newMsgs = old;
             const i = old.findIndex((m) => m.ID === data.ID);
             if (i === -1) return old;
-            newMsgs[i].attachment_pending = false;
             newMsgs[i].attachment_type = data.attachment_type;
             return [...newMsgs];
           });
+          //the event goes to everyone in the room so it can't have links signed for this user
+          getAttachmentLinks(data.attachment.ID)
+            .then((links) =>
+              updateAttachment(data.ID, data.attachment.ID, links)
+            )
+            .catch(() => {});
+        }
+        if (data.event_type === "attachment_error") {
+          updateAttachment(data.ID, data.attachment_id, { status: "error" });
+          setMessages((old) => {
+            let newMsgs = old;
+            const i = old.findIndex((m) => m.ID === data.ID);
+            if (i === -1) return old;
+            newMsgs[i].attachment_error = true;
+            return [...newMsgs];
+          });
         }
         if (data.event_type === "message_delete") {
           setMessages((old) => [...old.filter((m) => m.ID !== data.ID)]);
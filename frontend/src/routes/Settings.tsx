@@ -45,24 +45,9 @@ export default function Settings() {
             withCredentials: true,
             data: formData,
           })
-            .then(async () => {
-              try {
-                const b64 = await new Promise<string>((resolve, reject) => {
-                  const fr = new FileReader();
-                  fr.readAsDataURL(fileRef.current!);
-                  fr.onloadend = () => resolve(fr.result as string);
-                  fr.onabort = () => reject("Aborted");
-                  fr.onerror = () => reject("Error");
-                });
-                updateUserState({ base64pfp: b64 });
-                closeModal();
-              } catch (e) {
-                openModal("Message", {
-                  err: true,
-                  msg: `${e}`,
-                  pen: false,
-                });
-              }
+            .then((res) => {
+              updateUserState({ pfp_url: res.pfp_url });
+              closeModal();
               setResMsg({ msg: "", err: false, pen: false });
             })
             .catch((e) => {
@@ -19,14 +19,9 @@ const getRoomImage = async (id: string, cancelToken: CancelToken) => {
   return URL.createObjectURL(blob);
 };
 
-const getAttachmentImage = async (msgId: string, cancelToken: CancelToken) => {
-  const data = await makeRequest(`/api/attachment/${msgId}`, {
-    responseType: "arraybuffer",
-    cancelToken,
-  });
-  const blob = new Blob([data], { type: "image/jpeg" });
-  return URL.createObjectURL(blob);
-};
+// signed links to an attachment, for attachments that finished uploading after the room was loaded
+const getAttachmentLinks = (id: string) =>
+  makeRequest(`/api/attachment/${id}/links`, { withCredentials: true });
 
 const createRoom = (data: { name: string }) =>
   makeRequest("/api/room", {
@@ -84,5 +79,5 @@ export {
   uploadRoomImage,
   getRoomImage,
   uploadAttachment,
-  getAttachmentImage,
+  getAttachmentLinks,
 };
@@ -0,0 +1,506 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/api/imaging"
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+	"github.com/web-stuff-98/golang-chat-learning-project/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+Room archives are zip files containing:
+	manifest.json          - format version, usernames and attachment types
+	room.json              - the room document with its messages as relaxed MongoDB extended JSON
+	image.<format>         - the room image, if it has one, named after its format (jpeg, png, gif or webp)
+	attachments/<id>       - the attachments of the messages, older attachments have the id of their message
+*/
+
+const Version = 1
+
+const maxRoomFileSize = 64 * 1024 * 1024        //64mb, room.json and manifest.json
+const maxArchiveFileSize = 20 * 1024 * 1024     //20mb, same as the upload limit for room images
+const maxAttachmentFileSize = 500 * 1024 * 1024 //500mb, same as the upload limit for attachments
+
+var ErrRoomNotFound = errors.New("Room not found")
+var ErrInvalidArchive = errors.New("Invalid room archive")
+
+// the status of a message attachment that failed, same as in the controllers
+const attachmentStatusError = "error"
+
+type Manifest struct {
+	Version     int               `json:"version"`
+	ExportedAt  time.Time         `json:"exported_at"`
+	Usernames   map[string]string `json:"usernames"`   // uid -> username for every user referenced in the room, used to match them up on import
+	Attachments map[string]string `json:"attachments"` // attachment id -> mime type, imports find the type from the contents instead
+	HasImage    bool              `json:"has_image"`
+}
+
+// every user id referenced by the room
+func referencedUids(room *models.Room) []primitive.ObjectID {
+	seen := make(map[primitive.ObjectID]bool)
+	add := func(hex string) {
+		if oid, err := primitive.ObjectIDFromHex(hex); err == nil {
+			seen[oid] = true
+		}
+	}
+	seen[room.Author] = true
+	for _, uid := range room.Moderators {
+		seen[uid] = true
+	}
+	for _, m := range room.Messages {
+		add(m.Uid)
+		add(m.PinnedBy)
+		if m.ReplyTo != nil {
+			add(m.ReplyTo.Uid)
+		}
+		for _, uids := range m.Reactions {
+			for _, uid := range uids {
+				seen[uid] = true
+			}
+		}
+	}
+	uids := []primitive.ObjectID{}
+	for uid := range seen {
+		uids = append(uids, uid)
+	}
+	return uids
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Write the room, its image and its attachments to w as a zip archive
+func Export(ctx context.Context, roomId primitive.ObjectID, w io.Writer) error {
+	var room models.Room
+	if err := db.RoomCollection.FindOne(ctx, bson.M{"_id": roomId}).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrRoomNotFound
+		}
+		return err
+	}
+
+	manifest := Manifest{
+		Version:     Version,
+		ExportedAt:  time.Now().UTC(),
+		Usernames:   make(map[string]string),
+		Attachments: make(map[string]string),
+	}
+	cursor, err := db.UserCollection.Find(ctx, bson.M{"_id": bson.M{"$in": referencedUids(&room)}})
+	if err != nil {
+		return err
+	}
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			cursor.Close(ctx)
+			return err
+		}
+		manifest.Usernames[user.ID.Hex()] = user.Username
+	}
+	cursor.Close(ctx)
+
+	zw := zip.NewWriter(w)
+
+	roomJSON, err := bson.MarshalExtJSONIndent(room, false, false, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "room.json", roomJSON); err != nil {
+		return err
+	}
+
+	if img, err := storage.RoomImages.Get(ctx, roomId); err == nil {
+		manifest.HasImage = true
+		name := "image"
+		if format := imaging.DetectFormat(img); format != "" {
+			name += "." + format
+		}
+		if err := writeZipFile(zw, name, img); err != nil {
+			return err
+		}
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	msgIds := []primitive.ObjectID{}
+	for _, m := range room.Messages {
+		if m.HasAttachment {
+			msgIds = append(msgIds, m.ID)
+		}
+	}
+	//attachments are streamed straight from GridFS or the blob store into the zip
+	attachments, err := storage.FindAttachments(ctx, msgIds)
+	if err != nil {
+		return err
+	}
+	for _, attachment := range attachments {
+		manifest.Attachments[attachment.ID.Hex()] = attachment.Metadata.MimeType
+		stream, err := storage.OpenAttachment(ctx, &attachment, 0, -1)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create("attachments/" + attachment.ID.Hex())
+		if err == nil {
+			_, err = io.Copy(w, stream)
+		}
+		stream.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "manifest.json", manifestJSON); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// the new ids of an imported attachment and its message
+type newAttachment struct {
+	id    primitive.ObjectID
+	msgId primitive.ObjectID
+}
+
+func readZipFile(f *zip.File, maxSize int64) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(maxSize) {
+		return nil, fmt.Errorf("%w: %v is too large", ErrInvalidArchive, f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	//the header size can't be trusted so limit the read as well
+	data, err := io.ReadAll(io.LimitReader(rc, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("%w: %v is too large", ErrInvalidArchive, f.Name)
+	}
+	return data, nil
+}
+
+// the room image, archives from before it was named after its format always have image.jpg
+func imageZipFile(files map[string]*zip.File) *zip.File {
+	for name, f := range files {
+		if name == "image" || strings.HasPrefix(name, "image.") {
+			return f
+		}
+	}
+	return nil
+}
+
+// Find the type of a file from its contents, the same way it's done when an attachment is uploaded. The reader
+// returned has the whole file, including the part that was read to find the type.
+func sniffContentType(r io.Reader) (string, io.Reader, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	return http.DetectContentType(header[:n]), io.MultiReader(bytes.NewReader(header[:n]), r), nil
+}
+
+// How the users referenced in an archive are matched up with accounts when it is imported
+type ImportOptions struct {
+	// Match every user to the account with the same username, anyone without one keeps their old ID. Only for
+	// trusted archives, like ones imported from the command line. Otherwise only the importers own username is
+	// matched and everyone else gets a new placeholder ID, so an archive can't attribute messages to real users.
+	MatchUsers bool
+	// Called with the room once its IDs have been replaced, an error rejects the archive
+	Validate func(room *models.Room) error
+}
+
+// Recreate a room from an archive written by Export. The room, its messages and attachments get new IDs and
+// the room is owned by authorId. See ImportOptions for how users are matched up. Messages are stamped with the
+// time of the import, because the cleanup deletes messages by their age. Returns the ID of the new room.
+func Import(ctx context.Context, r io.ReaderAt, size int64, authorId primitive.ObjectID, opts ImportOptions) (primitive.ObjectID, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return primitive.NilObjectID, ErrInvalidArchive
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	if files["manifest.json"] == nil || files["room.json"] == nil {
+		return primitive.NilObjectID, fmt.Errorf("%w: missing manifest.json or room.json", ErrInvalidArchive)
+	}
+
+	var manifest Manifest
+	data, err := readZipFile(files["manifest.json"], maxRoomFileSize)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return primitive.NilObjectID, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	if manifest.Version != Version {
+		return primitive.NilObjectID, fmt.Errorf("%w: unsupported version %d", ErrInvalidArchive, manifest.Version)
+	}
+	var room models.Room
+	if data, err = readZipFile(files["room.json"], maxRoomFileSize); err != nil {
+		return primitive.NilObjectID, err
+	}
+	if err := bson.UnmarshalExtJSON(data, false, &room); err != nil {
+		return primitive.NilObjectID, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	//match users up by username
+	uidMap := make(map[primitive.ObjectID]primitive.ObjectID)
+	if opts.MatchUsers {
+		usernames := []string{}
+		uidsByUsername := make(map[string]primitive.ObjectID)
+		for uidHex, username := range manifest.Usernames {
+			if oid, err := primitive.ObjectIDFromHex(uidHex); err == nil {
+				usernames = append(usernames, username)
+				uidsByUsername[username] = oid
+			}
+		}
+		cursor, err := db.UserCollection.Find(ctx, bson.M{"username": bson.M{"$in": usernames}})
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		for cursor.Next(ctx) {
+			var user models.User
+			if err := cursor.Decode(&user); err != nil {
+				cursor.Close(ctx)
+				return primitive.NilObjectID, err
+			}
+			uidMap[uidsByUsername[user.Username]] = user.ID
+		}
+		cursor.Close(ctx)
+	} else {
+		var importer models.User
+		if err := db.UserCollection.FindOne(ctx, bson.M{"_id": authorId}).Decode(&importer); err != nil {
+			return primitive.NilObjectID, err
+		}
+		for uidHex, username := range manifest.Usernames {
+			if oid, err := primitive.ObjectIDFromHex(uidHex); err == nil && username == importer.Username {
+				uidMap[oid] = authorId
+			}
+		}
+	}
+	placeholders := make(map[primitive.ObjectID]bool)
+	mapUid := func(uid primitive.ObjectID) primitive.ObjectID {
+		if mapped, ok := uidMap[uid]; ok {
+			return mapped
+		}
+		if opts.MatchUsers {
+			return uid
+		}
+		placeholder := primitive.NewObjectID()
+		uidMap[uid] = placeholder
+		placeholders[placeholder] = true
+		return placeholder
+	}
+	mapUidHex := func(hex string) string {
+		if oid, err := primitive.ObjectIDFromHex(hex); err == nil {
+			return mapUid(oid).Hex()
+		}
+		return hex
+	}
+
+	//new ids are generated in message order so they still sort the same way after being re-stamped
+	now := primitive.NewDateTimeFromTime(time.Now())
+	msgIdMap := make(map[primitive.ObjectID]primitive.ObjectID)
+	for _, m := range room.Messages {
+		msgIdMap[m.ID] = primitive.NewObjectID()
+	}
+	//attachments get new ids as well, older ones without a list keep having the id of their message
+	attachmentIdMap := make(map[primitive.ObjectID]newAttachment)
+	for i := range room.Messages {
+		m := &room.Messages[i]
+		if len(m.Attachments) == 0 && m.HasAttachment {
+			attachmentIdMap[m.ID] = newAttachment{msgIdMap[m.ID], msgIdMap[m.ID]}
+			if _, ok := manifest.Attachments[m.ID.Hex()]; !ok {
+				//the attachment never finished uploading or was lost
+				m.AttachmentPending = false
+				m.AttachmentError = true
+			}
+		}
+		for j := range m.Attachments {
+			a := &m.Attachments[j]
+			if _, ok := manifest.Attachments[a.ID.Hex()]; !ok && a.Status != attachmentStatusError {
+				a.Status = attachmentStatusError
+				m.AttachmentError = true
+			}
+			attachmentIdMap[a.ID] = newAttachment{primitive.NewObjectID(), msgIdMap[m.ID]}
+			a.ID = attachmentIdMap[a.ID].id
+		}
+		m.AttachmentPending = false
+		m.ID = msgIdMap[m.ID]
+		m.Timestamp = now
+		if m.LastReplyAt != 0 {
+			m.LastReplyAt = now
+		}
+		m.Uid = mapUidHex(m.Uid)
+		if m.PinnedBy != "" {
+			m.PinnedBy = mapUidHex(m.PinnedBy)
+		}
+		if m.ParentID != nil {
+			if parentId, ok := msgIdMap[*m.ParentID]; ok {
+				m.ParentID = &parentId
+			} else {
+				m.ParentID = nil
+			}
+		}
+		if m.ReplyTo != nil {
+			if quotedId, ok := msgIdMap[m.ReplyTo.ID]; ok {
+				m.ReplyTo.ID = quotedId
+			}
+			m.ReplyTo.Uid = mapUidHex(m.ReplyTo.Uid)
+		}
+		for emoji, uids := range m.Reactions {
+			for j := range uids {
+				uids[j] = mapUid(uids[j])
+			}
+			m.Reactions[emoji] = uids
+		}
+	}
+	moderators := []primitive.ObjectID{}
+	for _, uid := range room.Moderators {
+		if uid = mapUid(uid); uid != authorId && !placeholders[uid] {
+			moderators = append(moderators, uid)
+		}
+	}
+	if room.Messages == nil {
+		room.Messages = []models.Message{}
+	}
+	if room.Tags == nil {
+		room.Tags = []string{}
+	}
+	if opts.Validate != nil {
+		if err := opts.Validate(&room); err != nil {
+			return primitive.NilObjectID, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+	}
+
+	//don't clash with one of the users other rooms
+	name := room.Name
+	for i := 2; ; i++ {
+		err := db.RoomCollection.FindOne(ctx, bson.M{"author_id": authorId, "name": bson.M{"$regex": "^" + regexp.QuoteMeta(name) + "$", "$options": "i"}}).Err()
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return primitive.NilObjectID, err
+		}
+		name = fmt.Sprintf("%v (%d)", room.Name, i)
+	}
+
+	room.ID = primitive.NewObjectID()
+	room.Name = name
+	room.Author = authorId
+	room.Moderators = moderators
+	room.UpdatedAt = now
+	if !manifest.HasImage {
+		room.ImgBlur = ""
+		room.ImgBlurHash = ""
+	}
+
+	//files go in first so the room never shows up with missing attachments. if anything fails they're removed again.
+	newMsgIds := []primitive.ObjectID{}
+	for _, msgId := range msgIdMap {
+		newMsgIds = append(newMsgIds, msgId)
+	}
+	cleanup := func() {
+		storage.RoomImages.Delete(context.TODO(), room.ID)
+		storage.DeleteAttachments(context.TODO(), newMsgIds)
+	}
+	if imageFile := imageZipFile(files); manifest.HasImage && imageFile != nil {
+		data, err := readZipFile(imageFile, maxArchiveFileSize)
+		if err != nil {
+			cleanup()
+			return primitive.NilObjectID, err
+		}
+		if imaging.DetectFormat(data) == "" {
+			cleanup()
+			return primitive.NilObjectID, fmt.Errorf("%w: %v is not an image", ErrInvalidArchive, imageFile.Name)
+		}
+		if err := storage.RoomImages.Save(ctx, room.ID, data); err != nil {
+			cleanup()
+			return primitive.NilObjectID, err
+		}
+	}
+	//the types in the manifest can't be trusted, they're found from the contents like they are for an upload
+	mimeTypes := make(map[primitive.ObjectID]string)
+	for oldIdHex := range manifest.Attachments {
+		oldId, err := primitive.ObjectIDFromHex(oldIdHex)
+		if err != nil {
+			cleanup()
+			return primitive.NilObjectID, fmt.Errorf("%w: invalid attachment id %v", ErrInvalidArchive, oldIdHex)
+		}
+		attachment, ok := attachmentIdMap[oldId]
+		f := files["attachments/"+oldIdHex]
+		if !ok || f == nil {
+			continue
+		}
+		if f.UncompressedSize64 > maxAttachmentFileSize {
+			cleanup()
+			return primitive.NilObjectID, fmt.Errorf("%w: %v is too large", ErrInvalidArchive, f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			cleanup()
+			return primitive.NilObjectID, err
+		}
+		mimeType, src, err := sniffContentType(rc)
+		if err == nil {
+			mimeTypes[attachment.id] = mimeType
+			err = storage.PutAttachment(ctx, attachment.id, attachment.msgId, oldIdHex, mimeType, io.LimitReader(src, maxAttachmentFileSize), int64(f.UncompressedSize64))
+		}
+		rc.Close()
+		if err != nil {
+			cleanup()
+			return primitive.NilObjectID, err
+		}
+	}
+	for i := range room.Messages {
+		m := &room.Messages[i]
+		for j := range m.Attachments {
+			if mimeType, ok := mimeTypes[m.Attachments[j].ID]; ok {
+				m.Attachments[j].MimeType = mimeType
+			}
+		}
+		//the type of the first attachment, older attachments have the id of their message
+		if len(m.Attachments) > 0 {
+			m.AttachmentType = m.Attachments[0].MimeType
+		} else if mimeType, ok := mimeTypes[m.ID]; ok {
+			m.AttachmentType = mimeType
+		}
+	}
+
+	if _, err := db.RoomCollection.InsertOne(ctx, room); err != nil {
+		cleanup()
+		return primitive.NilObjectID, err
+	}
+	return room.ID, nil
+}
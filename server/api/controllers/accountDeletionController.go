@@ -0,0 +1,368 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+	"github.com/web-stuff-98/golang-chat-learning-project/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultAccountDeletionGracePeriod = 24 * time.Hour
+const accountDeletionLease = 5 * time.Minute //how long a job is locked for while it's being worked on
+const maxAccountDeletionAttempts = 5
+
+const (
+	accountDeletionScheduled = "scheduled"
+	accountDeletionRunning   = "running"
+	accountDeletionDone      = "done"
+	accountDeletionCancelled = "cancelled"
+	accountDeletionFailed    = "failed"
+)
+
+// how long users have to cancel deleting their account, can be changed with the ACCOUNT_DELETION_GRACE_PERIOD
+// environment variable (a duration like "30m")
+func accountDeletionGracePeriod() time.Duration {
+	if grace, err := time.ParseDuration(os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD")); err == nil && grace >= 0 {
+		return grace
+	}
+	return defaultAccountDeletionGracePeriod
+}
+
+type accountDeletionStep struct {
+	name string
+	run  func(ctx context.Context, uid primitive.ObjectID) error
+}
+
+// every step can be run again safely, a step that failed part way through is run from the start on the next attempt.
+// the user is deleted last so nothing is left pointing at a user that no longer exists.
+var accountDeletionSteps = []accountDeletionStep{
+	{"sessions", func(ctx context.Context, uid primitive.ObjectID) error {
+		_, err := db.SessionCollection.DeleteMany(ctx, bson.M{"_uid": uid})
+		return err
+	}},
+	{"uploads", func(ctx context.Context, uid primitive.ObjectID) error {
+		cursor, err := db.UploadCollection.Find(ctx, bson.M{"uid": uid})
+		if err != nil {
+			return err
+		}
+		var uploads []models.Upload
+		if err := cursor.All(ctx, &uploads); err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			if err := deleteUpload(ctx, upload.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"messages", deleteUserMessages},
+	{"rooms", deleteUserRooms},
+	{"pfp", func(ctx context.Context, uid primitive.ObjectID) error {
+		return storage.Pfps.Delete(ctx, uid)
+	}},
+	{"notifications", func(ctx context.Context, uid primitive.ObjectID) error {
+		if _, err := db.NotificationCollection.DeleteMany(ctx, bson.M{"uid": uid}); err != nil {
+			return err
+		}
+		_, err := db.ReadStateCollection.DeleteMany(ctx, bson.M{"uid": uid})
+		return err
+	}},
+	{"exports", func(ctx context.Context, uid primitive.ObjectID) error {
+		return DeleteDataExports(ctx, bson.M{"uid": uid})
+	}},
+	{"user", func(ctx context.Context, uid primitive.ObjectID) error {
+		_, err := db.UserCollection.DeleteOne(ctx, bson.M{"_id": uid})
+		return err
+	}},
+}
+
+// delete the users messages, the replies to their threads and their attachments from rooms owned by other users
+func deleteUserMessages(ctx context.Context, uid primitive.ObjectID) error {
+	cursor, err := db.RoomCollection.Find(ctx, bson.M{"author_id": bson.M{"$ne": uid}, "messages.uid": uid.Hex()})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var room models.Room
+		if err := cursor.Decode(&room); err != nil {
+			return err
+		}
+		//replies in threads the user started go too, they can't be reached without the parent
+		parentIds := []primitive.ObjectID{}
+		for _, m := range room.Messages {
+			if m.Uid == uid.Hex() && m.ParentID == nil {
+				parentIds = append(parentIds, m.ID)
+			}
+		}
+		isParent := make(map[primitive.ObjectID]bool)
+		for _, id := range parentIds {
+			isParent[id] = true
+		}
+		msgIds := []primitive.ObjectID{}
+		for _, m := range room.Messages {
+			if m.Uid == uid.Hex() || (m.ParentID != nil && isParent[*m.ParentID]) {
+				msgIds = append(msgIds, m.ID)
+			}
+		}
+		if err := storage.DeleteAttachments(ctx, msgIds); err != nil {
+			return err
+		}
+		if _, err := db.RoomCollection.UpdateByID(ctx, room.ID, bson.M{"$pull": bson.M{"messages": bson.M{"$or": bson.A{
+			bson.M{"uid": uid.Hex()},
+			bson.M{"parent_id": bson.M{"$in": parentIds}},
+		}}}}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// delete the rooms the user owns, with their images and attachments
+func deleteUserRooms(ctx context.Context, uid primitive.ObjectID) error {
+	cursor, err := db.RoomCollection.Find(ctx, bson.M{"author_id": uid})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var room models.Room
+		if err := cursor.Decode(&room); err != nil {
+			return err
+		}
+		msgIds := []primitive.ObjectID{}
+		for _, m := range room.Messages {
+			msgIds = append(msgIds, m.ID)
+		}
+		if err := storage.DeleteAttachments(ctx, msgIds); err != nil {
+			return err
+		}
+		if err := storage.RoomImages.Delete(ctx, room.ID); err != nil {
+			return err
+		}
+		//the room goes last so if anything above fails the room is still there to be found on the next attempt
+		if _, err := db.RoomCollection.DeleteOne(ctx, bson.M{"_id": room.ID}); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// Schedule deleting the user after the grace period. If there is already a deletion scheduled it's moved earlier
+// if needed, and if the user has already been deleted the finished job is returned.
+func scheduleAccountDeletion(ctx context.Context, uid primitive.ObjectID, grace time.Duration) (*models.AccountDeletion, error) {
+	runAt := primitive.NewDateTimeFromTime(time.Now().Add(grace))
+	var job models.AccountDeletion
+	err := db.AccountDeletionCollection.FindOne(ctx, bson.M{
+		"uid":    uid,
+		"status": bson.M{"$in": bson.A{accountDeletionScheduled, accountDeletionRunning, accountDeletionDone}},
+	}).Decode(&job)
+	if err == nil {
+		if job.Status == accountDeletionScheduled && job.RunAt > runAt {
+			job.RunAt = runAt
+			if _, err := db.AccountDeletionCollection.UpdateByID(ctx, job.ID, bson.M{"$set": bson.M{"run_at": runAt}}); err != nil {
+				return nil, err
+			}
+		}
+		return &job, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	job = models.AccountDeletion{
+		ID:             primitive.NewObjectID(),
+		Uid:            uid,
+		Status:         accountDeletionScheduled,
+		CompletedSteps: []string{},
+		CreatedAt:      primitive.NewDateTimeFromTime(time.Now()),
+		RunAt:          runAt,
+	}
+	if _, err := db.AccountDeletionCollection.InsertOne(ctx, job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Schedule deleting the user straight away for the old account cleanup. If the user already has a deletion
+// scheduled it's left as it is, so the grace period they were given isn't cut short.
+func scheduleAccountCleanup(ctx context.Context, uid primitive.ObjectID) error {
+	err := db.AccountDeletionCollection.FindOne(ctx, bson.M{
+		"uid":    uid,
+		"status": bson.M{"$in": bson.A{accountDeletionScheduled, accountDeletionRunning, accountDeletionDone}},
+	}).Err()
+	if err == nil {
+		return nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+	_, err = scheduleAccountDeletion(ctx, uid, 0)
+	return err
+}
+
+// lock the next job that is due, if there is one. jobs left running by a server that stopped are picked up again
+// once their lock runs out.
+func claimAccountDeletion(ctx context.Context) (*models.AccountDeletion, error) {
+	now := primitive.NewDateTimeFromTime(time.Now())
+	var job models.AccountDeletion
+	err := db.AccountDeletionCollection.FindOneAndUpdate(ctx, bson.M{
+		"status":       bson.M{"$in": bson.A{accountDeletionScheduled, accountDeletionRunning}},
+		"run_at":       bson.M{"$lte": now},
+		"locked_until": bson.M{"$lt": now},
+	}, bson.M{"$set": bson.M{
+		"status":       accountDeletionRunning,
+		"locked_until": primitive.NewDateTimeFromTime(time.Now().Add(accountDeletionLease)),
+	}}, options.FindOneAndUpdate().SetSort(bson.M{"run_at": 1}).SetReturnDocument(options.After)).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// go through the steps the job hasn't done yet, saving progress after each one
+func runAccountDeletion(ctx context.Context, job *models.AccountDeletion) error {
+	completed := make(map[string]bool)
+	for _, step := range job.CompletedSteps {
+		completed[step] = true
+	}
+	for _, step := range accountDeletionSteps {
+		if completed[step.name] {
+			continue
+		}
+		if err := step.run(ctx, job.Uid); err != nil {
+			return fmt.Errorf("step %v : %w", step.name, err)
+		}
+		if _, err := db.AccountDeletionCollection.UpdateByID(ctx, job.ID, bson.M{
+			"$push": bson.M{"completed_steps": step.name},
+			"$set":  bson.M{"locked_until": primitive.NewDateTimeFromTime(time.Now().Add(accountDeletionLease))},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Works through account deletion jobs as their grace periods end. Failed jobs are retried with a growing delay
+// until they have failed maxAccountDeletionAttempts times.
+func watchAccountDeletions(chatServer *ChatServer, removeChatServerConnByUID chan string) {
+	ticker := time.NewTicker(30 * time.Second)
+	for range ticker.C {
+		for {
+			job, err := claimAccountDeletion(context.TODO())
+			if err != nil {
+				log.Println("Account deletion claim error : ", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+
+			if err := runAccountDeletion(context.TODO(), job); err != nil {
+				log.Println("Account deletion error : ", err)
+				update := bson.M{
+					"last_error":   err.Error(),
+					"locked_until": primitive.DateTime(0),
+					"run_at":       primitive.NewDateTimeFromTime(time.Now().Add(time.Duration(job.Attempts+1) * time.Minute)),
+				}
+				if job.Attempts+1 >= maxAccountDeletionAttempts {
+					update["status"] = accountDeletionFailed
+				}
+				db.AccountDeletionCollection.UpdateByID(context.TODO(), job.ID, bson.M{"$set": update, "$inc": bson.M{"attempts": 1}})
+				continue
+			}
+
+			db.AccountDeletionCollection.UpdateByID(context.TODO(), job.ID, bson.M{"$set": bson.M{
+				"status":       accountDeletionDone,
+				"completed_at": primitive.NewDateTimeFromTime(time.Now()),
+				"locked_until": primitive.DateTime(0),
+			}})
+			for conn := range chatServer.connections {
+				if conn.Locals("uid").(primitive.ObjectID) != job.Uid {
+					conn.WriteJSON(fiber.Map{
+						"ID":         job.Uid.Hex(),
+						"event_type": "user_delete",
+					})
+				}
+			}
+			removeChatServerConnByUID <- job.Uid.Hex()
+		}
+	}
+}
+
+// Get the users scheduled account deletion
+func HandleGetAccountDeletion(c *fiber.Ctx) error {
+	var job models.AccountDeletion
+	err := db.AccountDeletionCollection.FindOne(c.Context(), bson.M{
+		"uid":    c.Locals("uid").(primitive.ObjectID),
+		"status": bson.M{"$in": bson.A{accountDeletionScheduled, accountDeletionRunning}},
+	}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(fiber.StatusNotFound)
+			return c.JSON(fiber.Map{
+				"message": "Your account is not scheduled for deletion",
+			})
+		}
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+
+	c.Status(fiber.StatusOK)
+	return c.JSON(job)
+}
+
+// Cancel deleting the users account. Only works during the grace period, before the job has started.
+func HandleCancelAccountDeletion(c *fiber.Ctx) error {
+	uid := c.Locals("uid").(primitive.ObjectID)
+	res, err := db.AccountDeletionCollection.UpdateOne(c.Context(), bson.M{
+		"uid":             uid,
+		"status":          accountDeletionScheduled,
+		"attempts":        0,
+		"locked_until":    bson.M{"$lt": primitive.NewDateTimeFromTime(time.Now())},
+		"completed_steps": bson.M{"$size": 0},
+	}, bson.M{"$set": bson.M{"status": accountDeletionCancelled}})
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	if res.ModifiedCount == 0 {
+		if db.AccountDeletionCollection.FindOne(c.Context(), bson.M{
+			"uid":    uid,
+			"status": bson.M{"$in": bson.A{accountDeletionScheduled, accountDeletionRunning}},
+		}).Err() == nil {
+			c.Status(fiber.StatusConflict)
+			return c.JSON(fiber.Map{
+				"message": "Your account is already being deleted",
+			})
+		}
+		c.Status(fiber.StatusNotFound)
+		return c.JSON(fiber.Map{
+			"message": "Your account is not scheduled for deletion",
+		})
+	}
+
+	c.Status(fiber.StatusOK)
+	return c.JSON(fiber.Map{
+		"message": "Account deletion cancelled",
+	})
+}
@@ -0,0 +1,436 @@
+package controllers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/api/helpers"
+	"github.com/web-stuff-98/golang-chat-learning-project/api/imaging"
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxAttachmentsPerMessage = 10
+
+const (
+	attachmentStatusPending  = "pending"
+	attachmentStatusComplete = "complete"
+	attachmentStatusError    = "error"
+)
+
+var (
+	errNoAttachments      = errors.New("This message doesn't have attachments")
+	errAttachmentExists   = errors.New("Attachment already exists")
+	errTooManyAttachments = errors.New("Messages can have up to 10 attachments")
+)
+
+// Check that the user can add an attachment to the message. Messages from before there could be more than one
+// attachment can't have any more added.
+func checkCanAddAttachment(ctx context.Context, roomId primitive.ObjectID, msgId primitive.ObjectID, uid primitive.ObjectID) error {
+	_, msg, err := findRoomMessage(ctx, roomId, msgId)
+	if err != nil {
+		return err
+	}
+	if msg.Uid != uid.Hex() {
+		return errNotAllowed
+	}
+	if !msg.HasAttachment {
+		return errNoAttachments
+	}
+	if len(msg.Attachments) >= maxAttachmentsPerMessage {
+		return errTooManyAttachments
+	}
+	if err := db.AttachmentCollection.FindOne(ctx, bson.M{"_id": msgId}).Err(); err == nil {
+		return errAttachmentExists
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+	return nil
+}
+
+// Add a pending attachment to the message's list and tell the clients in the room, so they can show it while it
+// uploads. Returns errTooManyAttachments if the list is full.
+func addMessageAttachment(ctx context.Context, chatServer *ChatServer, roomId primitive.ObjectID, msgId primitive.ObjectID, name string, size int64) (*models.MessageAttachment, error) {
+	attachment := &models.MessageAttachment{
+		ID:     primitive.NewObjectID(),
+		Name:   name,
+		Size:   size,
+		Status: attachmentStatusPending,
+	}
+	//the list is checked in the same update so two uploads at once can't go over the limit
+	res, err := db.RoomCollection.UpdateOne(ctx, bson.M{
+		"_id": roomId,
+		"messages": bson.M{"$elemMatch": bson.M{
+			"_id": msgId,
+			"attachments." + strconv.Itoa(maxAttachmentsPerMessage-1): bson.M{"$exists": false},
+		}},
+	}, bson.M{
+		"$push": bson.M{"messages.$.attachments": attachment},
+		"$set":  bson.M{"messages.$.attachment_pending": true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		return nil, errTooManyAttachments
+	}
+	sendToRoom(chatServer, roomId.Hex(), fiber.Map{
+		"event_type": "attachment_added",
+		"ID":         msgId.Hex(),
+		"attachment": attachment,
+	})
+	return attachment, nil
+}
+
+// Set fields of one of the message's attachments, then work out the message's attachment_pending,
+// attachment_error and attachment_type again from its list
+func updateMessageAttachment(ctx context.Context, roomId primitive.ObjectID, msgId primitive.ObjectID, attachmentId primitive.ObjectID, fields bson.M) error {
+	set := bson.M{}
+	for field, value := range fields {
+		set["messages.$[message].attachments.$[attachment]."+field] = value
+	}
+	if _, err := db.RoomCollection.UpdateOne(ctx, bson.M{"_id": roomId}, bson.M{"$set": set}, options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.M{"message._id": msgId}, bson.M{"attachment._id": attachmentId}},
+	})); err != nil {
+		return err
+	}
+	//done in one update so two uploads finishing at once can't leave it out of date
+	statuses := bson.M{"$ifNull": bson.A{"$$message.attachments.status", bson.A{}}}
+	_, err := db.RoomCollection.UpdateByID(ctx, roomId, bson.A{
+		bson.M{
+			"$set": bson.M{
+				"messages": bson.M{
+					"$map": bson.M{
+						"input": "$messages",
+						"as":    "message",
+						"in": bson.M{
+							"$cond": bson.M{
+								"if": bson.M{
+									"$eq": bson.A{"$$message._id", msgId},
+								},
+								"then": bson.M{
+									"$mergeObjects": bson.A{
+										"$$message",
+										bson.M{
+											"attachment_pending": bson.M{"$in": bson.A{attachmentStatusPending, statuses}},
+											"attachment_error":   bson.M{"$in": bson.A{attachmentStatusError, statuses}},
+											//pending attachments don't have a type yet
+											"attachment_type": bson.M{"$reduce": bson.M{
+												"input":        bson.M{"$ifNull": bson.A{"$$message.attachments.mime_type", bson.A{}}},
+												"initialValue": "",
+												"in":           bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$$value", ""}}, "$$this", "$$value"}},
+											}},
+										},
+									},
+								},
+								"else": "$$message",
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	return err
+}
+
+const defaultGalleryPageSize = 30
+const maxGalleryPageSize = 100
+
+// an attachment in the room gallery, with the message it was sent with
+type GalleryItem struct {
+	models.MessageAttachment `bson:",inline"`
+	MsgId                    primitive.ObjectID `bson:"msg_id" json:"msg_id"`
+	Uid                      string             `bson:"uid" json:"uid"`
+	Timestamp                primitive.DateTime `bson:"timestamp" json:"timestamp"`
+}
+
+// the types that can be filtered on in the gallery, anything that isn't one of these is a file
+var galleryTypePatterns = map[string]string{
+	"image": "^image/",
+	"video": "^video/",
+	"audio": "^(audio/|application/ogg$)",
+}
+
+// Get the finished attachments sent in a room, newest first. Filter with ?type=image, video, audio or file, and
+// pass next_cursor as ?cursor= for the next page.
+func HandleGetRoomAttachments(c *fiber.Ctx) error {
+	roomId, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Invalid ID",
+		})
+	}
+
+	limit := defaultGalleryPageSize
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > maxGalleryPageSize {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid limit",
+			})
+		}
+	}
+
+	match := bson.M{"status": attachmentStatusComplete}
+	switch t := c.Query("type"); t {
+	case "":
+	case "image", "video", "audio":
+		match["mime_type"] = bson.M{"$regex": galleryTypePatterns[t]}
+	case "file":
+		nor := bson.A{}
+		for _, pattern := range galleryTypePatterns {
+			nor = append(nor, bson.M{"mime_type": bson.M{"$regex": pattern}})
+		}
+		match["$nor"] = nor
+	default:
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Invalid type, use image, video, audio or file",
+		})
+	}
+	if c.Query("cursor") != "" {
+		cursorId, err := primitive.ObjectIDFromHex(c.Query("cursor"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid cursor",
+			})
+		}
+		match["_id"] = bson.M{"$lt": cursorId}
+	}
+
+	//only members of the room can see what was sent in it
+	var room models.Room
+	if err := db.RoomCollection.FindOne(c.Context(), bson.M{"_id": roomId}, options.FindOne().SetProjection(bson.M{
+		"author_id":    1,
+		"moderators":   1,
+		"messages.uid": 1,
+	})).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			err = errRoomNotFound
+		}
+		return messageCommandErrorResponse(c, err)
+	}
+	uid := c.Locals("uid").(primitive.ObjectID)
+	if _, ok := roomMembers(&room)[uid]; !ok {
+		return messageCommandErrorResponse(c, errNotRoomMember)
+	}
+
+	//messages from before there could be more than one attachment have it described on the message itself
+	legacyAttachment := bson.M{"$cond": bson.A{
+		bson.M{"$and": bson.A{"$messages.has_attachment", bson.M{"$not": bson.A{"$messages.attachment_pending"}}, bson.M{"$not": bson.A{"$messages.attachment_error"}}}},
+		bson.A{bson.M{"_id": "$messages._id", "name": "", "size": 0, "mime_type": "$messages.attachment_type", "status": attachmentStatusComplete}},
+		bson.A{},
+	}}
+	cursor, err := db.RoomCollection.Aggregate(c.Context(), bson.A{
+		bson.M{"$match": bson.M{"_id": roomId}},
+		bson.M{"$project": bson.M{"messages": 1}},
+		bson.M{"$unwind": "$messages"},
+		bson.M{"$match": bson.M{"messages.has_attachment": true}},
+		bson.M{"$project": bson.M{
+			"msg_id":    "$messages._id",
+			"uid":       "$messages.uid",
+			"timestamp": "$messages.timestamp",
+			"attachments": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{bson.M{"$size": bson.M{"$ifNull": bson.A{"$messages.attachments", bson.A{}}}}, 0}},
+				"$messages.attachments",
+				legacyAttachment,
+			}},
+		}},
+		bson.M{"$unwind": "$attachments"},
+		bson.M{"$replaceRoot": bson.M{"newRoot": bson.M{"$mergeObjects": bson.A{
+			"$attachments",
+			bson.M{"msg_id": "$msg_id", "uid": "$uid", "timestamp": "$timestamp"},
+		}}}},
+		bson.M{"$match": match},
+		bson.M{"$sort": bson.M{"_id": -1}},
+		//one extra to know if there is another page
+		bson.M{"$limit": limit + 1},
+	})
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	items := []GalleryItem{}
+	if err := cursor.All(c.Context(), &items); err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+
+	nextCursor := ""
+	if len(items) > limit {
+		items = items[:limit]
+		nextCursor = items[limit-1].ID.Hex()
+	}
+	for i := range items {
+		signAttachmentLinks(&items[i].MessageAttachment, uid)
+	}
+
+	c.Status(fiber.StatusOK)
+	return c.JSON(fiber.Map{
+		"attachments": items,
+		"next_cursor": nextCursor,
+	})
+}
+
+// signed attachment links expire on the hour boundary after this long, so they work for between one and two hours
+// and a link to the same attachment stays the same for an hour, which lets the browser cache it
+const attachmentLinkExpiry = time.Hour
+
+var errInvalidAttachmentLink = errors.New("This link is invalid or has expired")
+var errNotRoomMember = errors.New("Only members of the room can get its attachments")
+
+// the key attachment links are signed with. it's made from SECRET, so the same key isn't used for sessions
+func attachmentLinkKey() []byte {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("SECRET")))
+	mac.Write([]byte("attachment links"))
+	return mac.Sum(nil)
+}
+
+func attachmentLinkSignature(attachmentId primitive.ObjectID, uid primitive.ObjectID, expires int64) []byte {
+	mac := hmac.New(sha256.New, attachmentLinkKey())
+	fmt.Fprintf(mac, "%v.%v.%d", attachmentId.Hex(), uid.Hex(), expires)
+	return mac.Sum(nil)
+}
+
+// The query string that lets the user get the attachment without a session until it expires. The smaller sizes
+// of an image use the same one.
+func signAttachmentLink(attachmentId primitive.ObjectID, uid primitive.ObjectID) string {
+	expires := time.Now().Add(attachmentLinkExpiry).Truncate(time.Hour).Add(time.Hour).Unix()
+	return fmt.Sprintf("uid=%v&expires=%d&sig=%v", uid.Hex(), expires, base64.RawURLEncoding.EncodeToString(attachmentLinkSignature(attachmentId, uid, expires)))
+}
+
+// Set the links to download, view and show a thumbnail of the attachment, signed for the user
+func signAttachmentLinks(attachment *models.MessageAttachment, uid primitive.ObjectID) {
+	query := signAttachmentLink(attachment.ID, uid)
+	attachment.URL = "/api/attachment/download/" + attachment.ID.Hex() + "?" + query
+	if inlineAttachmentTypes[attachment.MimeType] {
+		attachment.ViewURL = "/api/attachment/view/" + attachment.ID.Hex() + "?" + query
+	}
+	if resizableAttachmentTypes[attachment.MimeType] {
+		attachment.ThumbURL = "/api/attachment/view/" + attachment.ID.Hex() + "?size=" + imaging.Thumb.Name + "&" + query
+	}
+}
+
+// Sign the links to the finished attachments of each message for the user. A signed link works without checking
+// membership again, so only members of the room (see roomMembers) get them, anyone else gets no links.
+func signMessageAttachments(msgs []models.Message, members map[primitive.ObjectID]struct{}, uid primitive.ObjectID) {
+	_, member := members[uid]
+	for i := range msgs {
+		for j := range msgs[i].Attachments {
+			attachment := &msgs[i].Attachments[j]
+			if member && attachment.Status == attachmentStatusComplete {
+				signAttachmentLinks(attachment, uid)
+			} else {
+				attachment.URL, attachment.ViewURL, attachment.ThumbURL = "", "", ""
+			}
+		}
+	}
+}
+
+// Check that the request can get the attachment. Signed links are checked against their signature and expiry,
+// anything else needs the session of a user who is a member of the room the attachment was sent in.
+func checkAttachmentAccess(c *fiber.Ctx, attachment *models.Attachment) error {
+	if c.Query("sig") != "" {
+		uid, err := primitive.ObjectIDFromHex(c.Query("uid"))
+		if err != nil {
+			return errInvalidAttachmentLink
+		}
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil || time.Now().Unix() > expires {
+			return errInvalidAttachmentLink
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(c.Query("sig"))
+		if err != nil || !hmac.Equal(sig, attachmentLinkSignature(attachment.ID, uid, expires)) {
+			return errInvalidAttachmentLink
+		}
+		return nil
+	}
+	uid, err := helpers.DecodeTokenAndGetUID(c)
+	if err != nil {
+		return errNotAllowed
+	}
+	return checkAttachmentMember(c.Context(), attachment, uid)
+}
+
+// Check that the user is a member of the room the attachment was sent in
+func checkAttachmentMember(ctx context.Context, attachment *models.Attachment, uid primitive.ObjectID) error {
+	//attachments from before messages could have more than one have the id of their message
+	msgId := attachment.Metadata.MsgId
+	if msgId.IsZero() {
+		msgId = attachment.ID
+	}
+	var room models.Room
+	if err := db.RoomCollection.FindOne(ctx, bson.M{"messages._id": msgId}, options.FindOne().SetProjection(bson.M{
+		"author_id":    1,
+		"moderators":   1,
+		"messages.uid": 1,
+	})).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return errMessageNotFound
+		}
+		return err
+	}
+	if _, ok := roomMembers(&room)[uid]; !ok {
+		return errNotRoomMember
+	}
+	return nil
+}
+
+// Get signed links to an attachment, for attachments the client doesn't already have links for
+func HandleGetAttachmentLinks(c *fiber.Ctx) error {
+	oid, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Invalid ID",
+		})
+	}
+
+	var attachment models.Attachment
+	if err := db.AttachmentCollection.FindOne(c.Context(), bson.M{"_id": oid}).Decode(&attachment); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(fiber.StatusNotFound)
+			return c.JSON(fiber.Map{
+				"message": "Attachment not found",
+			})
+		}
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	uid := c.Locals("uid").(primitive.ObjectID)
+	if err := checkAttachmentMember(c.Context(), &attachment, uid); err != nil {
+		return messageCommandErrorResponse(c, err)
+	}
+
+	links := models.MessageAttachment{ID: attachment.ID, MimeType: attachment.Metadata.MimeType}
+	signAttachmentLinks(&links, uid)
+	c.Status(fiber.StatusOK)
+	return c.JSON(fiber.Map{
+		"url":       links.URL,
+		"view_url":  links.ViewURL,
+		"thumb_url": links.ThumbURL,
+	})
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// a room with a message from its author that has a finished image attachment, and a thread reply from someone else
+func testAttachmentRoom(author primitive.ObjectID, replier primitive.ObjectID) models.Room {
+	msgId := primitive.NewObjectID()
+	return models.Room{
+		ID:     primitive.NewObjectID(),
+		Author: author,
+		Messages: []models.Message{
+			{
+				ID:            msgId,
+				Uid:           author.Hex(),
+				HasAttachment: true,
+				Attachments: []models.MessageAttachment{{
+					ID:       primitive.NewObjectID(),
+					MimeType: "image/png",
+					Status:   attachmentStatusComplete,
+				}},
+			},
+			{ID: primitive.NewObjectID(), Uid: replier.Hex(), ParentID: &msgId},
+		},
+	}
+}
+
+func TestPrepareRoomForClientSignsLinksForMembersOnly(t *testing.T) {
+	author, replier := primitive.NewObjectID(), primitive.NewObjectID()
+	tests := []struct {
+		name      string
+		uid       primitive.ObjectID
+		wantLinks bool
+	}{
+		{"author", author, true},
+		//replies are left out of the timeline, the user is still a member
+		{"thread replier", replier, true},
+		{"non-member", primitive.NewObjectID(), false},
+	}
+	for _, test := range tests {
+		room := testAttachmentRoom(author, replier)
+		prepareRoomForClient(&room, test.uid)
+		attachment := room.Messages[0].Attachments[0]
+		for _, link := range []string{attachment.URL, attachment.ViewURL, attachment.ThumbURL} {
+			if (link != "") != test.wantLinks {
+				t.Errorf("%v: got links %q, %q, %q, want links %v", test.name, attachment.URL, attachment.ViewURL, attachment.ThumbURL, test.wantLinks)
+				break
+			}
+		}
+	}
+}
+
+func TestGetAttachmentLinksRequiresMembership(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	author := primitive.NewObjectID()
+	room := testAttachmentRoom(author, primitive.NewObjectID())
+	attachmentId := room.Messages[0].Attachments[0].ID
+	tests := []struct {
+		name       string
+		uid        primitive.ObjectID
+		wantStatus int
+	}{
+		{"member", author, fiber.StatusOK},
+		{"non-member", primitive.NewObjectID(), fiber.StatusForbidden},
+	}
+	for _, test := range tests {
+		mt.Run(test.name, func(mt *mtest.T) {
+			attachmentCollection, roomCollection := db.AttachmentCollection, db.RoomCollection
+			db.AttachmentCollection, db.RoomCollection = mt.Coll, mt.Coll
+			defer func() {
+				db.AttachmentCollection, db.RoomCollection = attachmentCollection, roomCollection
+			}()
+
+			ns := mt.DB.Name() + "." + mt.Coll.Name()
+			messages := bson.A{}
+			for _, m := range room.Messages {
+				messages = append(messages, bson.D{{Key: "_id", Value: m.ID}, {Key: "uid", Value: m.Uid}})
+			}
+			mt.AddMockResponses(
+				mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{
+					{Key: "_id", Value: attachmentId},
+					{Key: "length", Value: int64(10)},
+					{Key: "metadata", Value: bson.D{
+						{Key: "attachment_type", Value: "image/png"},
+						{Key: "msg_id", Value: room.Messages[0].ID},
+					}},
+				}),
+				mtest.CreateCursorResponse(0, ns, mtest.FirstBatch, bson.D{
+					{Key: "_id", Value: room.ID},
+					{Key: "author_id", Value: room.Author},
+					{Key: "messages", Value: messages},
+				}),
+			)
+
+			app := fiber.New()
+			app.Get("/api/attachment/:id/links", func(c *fiber.Ctx) error {
+				c.Locals("uid", test.uid)
+				return c.Next()
+			}, HandleGetAttachmentLinks)
+			res, err := app.Test(httptest.NewRequest("GET", fmt.Sprintf("/api/attachment/%v/links", attachmentId.Hex()), nil))
+			if err != nil {
+				mt.Fatal(err)
+			}
+			if res.StatusCode != test.wantStatus {
+				mt.Errorf("got status %d, want %d", res.StatusCode, test.wantStatus)
+			}
+			var body struct {
+				URL string `json:"url"`
+			}
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				mt.Fatal(err)
+			}
+			if (body.URL != "") != (test.wantStatus == fiber.StatusOK) {
+				mt.Errorf("got url %q with status %d", body.URL, res.StatusCode)
+			}
+		})
+	}
+}
@@ -4,19 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
-	"image"
+	"errors"
+	"fmt"
 	"image/jpeg"
-	"image/png"
-	"io/ioutil"
+	"io"
 	"log"
-	"math"
+	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/web-stuff-98/golang-chat-learning-project/api/helpers"
+	"github.com/web-stuff-98/golang-chat-learning-project/api/imaging"
 	"github.com/web-stuff-98/golang-chat-learning-project/api/validator"
 	"github.com/web-stuff-98/golang-chat-learning-project/db"
 	"github.com/web-stuff-98/golang-chat-learning-project/models"
+	"github.com/web-stuff-98/golang-chat-learning-project/storage"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/websocket/v2"
@@ -25,16 +29,16 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type InboundMessage struct {
-	ID                primitive.ObjectID `bson:"_id" json:"ID"`
-	Content           string             `json:"content"`
-	SenderUid         string             `json:"uid"`
-	WsConn            *websocket.Conn    `json:"-"`
-	HasAttachment     bool               `json:"has_attachment"`
-	AttachmentPending bool               `json:"attachment_pending"`
+	ID                primitive.ObjectID    `bson:"_id" json:"ID"`
+	Content           string                `json:"content"`
+	SenderUid         string                `json:"uid"`
+	WsConn            *websocket.Conn       `json:"-"`
+	HasAttachment     bool                  `json:"has_attachment"`
+	AttachmentPending bool                  `json:"attachment_pending"`
+	ReplyTo           *models.QuotedMessage `json:"reply_to,omitempty"`
 }
 
 type ChatServer struct {
@@ -49,12 +53,24 @@ type ChatServer struct {
 
 	registerRoomConn   chan ChatRoomConnectionRegistration
 	unregisterRoomConn chan ChatRoomConnectionRegistration
+
+	registerThreadConn   chan ThreadConnectionRegistration
+	unregisterThreadConn chan ThreadConnectionRegistration
+
+	deleteMsgChan chan RoomIdMessageId
+
+	typingChan chan TypingEvent
+
+	presenceChan      chan PresenceEvent
+	presenceQueryChan chan PresenceQuery
 }
 
 type ChatRoom struct {
 	connections      map[*websocket.Conn]bool
 	connectionsByUid map[string]*websocket.Conn
 	roomId           string
+	//connections viewing a thread, by the parent message id
+	threadConnections map[string]map[*websocket.Conn]bool
 }
 
 type ChatRoomConnectionRegistration struct {
@@ -72,7 +88,7 @@ func NewServer() (*ChatServer, chan string, chan *websocket.Conn, chan string, c
 	removeChatServerConnByUID := make(chan string)
 	//removeChatServerConn can be used to close websockets using the actual websocket connection, removes the uid map value too
 	removeChatServerConn := make(chan *websocket.Conn)
-	//deleteUser channel is used in changestream, when a user is deleted delete all their messages, rooms and send ws event to other users0
+	//deleteUser channel is used in changestream and the old account cleanup, it starts a deletion job for the user straight away
 	deleteUserChan := make(chan string)
 	//deleteMsg channel is used to delete messages from a room
 	deleteMsgChan := make(chan RoomIdMessageId)
@@ -88,7 +104,17 @@ func NewServer() (*ChatServer, chan string, chan *websocket.Conn, chan string, c
 		registerRoomConn:   make(chan ChatRoomConnectionRegistration), //register connection by uid
 		unregisterRoomConn: make(chan ChatRoomConnectionRegistration), //unregister connection by uid
 
+		registerThreadConn:   make(chan ThreadConnectionRegistration),
+		unregisterThreadConn: make(chan ThreadConnectionRegistration),
+
 		chatRooms: make([]*ChatRoom, 0),
+
+		deleteMsgChan: deleteMsgChan,
+
+		typingChan: make(chan TypingEvent),
+
+		presenceChan:      make(chan PresenceEvent),
+		presenceQueryChan: make(chan PresenceQuery),
 	}
 
 	/* ------------------ Handle inbound messages ------------------ */
@@ -149,9 +175,15 @@ func NewServer() (*ChatServer, chan string, chan *websocket.Conn, chan string, c
 			delete(chatServer.connectionsByUid, uid)
 			delete(chatServer.connections, conn)
 			for i, _ := range chatServer.chatRooms {
+				_, inRoom := chatServer.chatRooms[i].connectionsByUid[uid]
 				delete(chatServer.chatRooms[i].connections, conn)
 				delete(chatServer.chatRooms[i].connectionsByUid, uid)
+				removeFromThreads(chatServer.chatRooms[i], conn)
+				if inRoom {
+					sendRoomLeave(chatServer, chatServer.chatRooms[i].roomId, uid)
+				}
 			}
+			chatServer.presenceChan <- PresenceEvent{uid: uid, kind: "disconnect"}
 		}
 	}()
 
@@ -163,99 +195,83 @@ func NewServer() (*ChatServer, chan string, chan *websocket.Conn, chan string, c
 			delete(chatServer.connections, c)
 			log.Println("Close chatserver connection : ", c.Locals("uid").(primitive.ObjectID).Hex())
 			for i, _ := range chatServer.chatRooms {
+				inRoom := chatServer.chatRooms[i].connections[c]
 				delete(chatServer.chatRooms[i].connections, c)
 				delete(chatServer.chatRooms[i].connectionsByUid, c.Locals("uid").(primitive.ObjectID).Hex())
+				removeFromThreads(chatServer.chatRooms[i], c)
+				if inRoom {
+					sendRoomLeave(chatServer, chatServer.chatRooms[i].roomId, c.Locals("uid").(primitive.ObjectID).Hex())
+				}
 			}
+			chatServer.presenceChan <- PresenceEvent{uid: c.Locals("uid").(primitive.ObjectID).Hex(), kind: "disconnect"}
 		}
 	}()
 
 	/* ------------------ Delete user channel ------------------ */
+	//deleting the account is done by a deletion job so it carries on if the server restarts part way through.
+	//the job sends user_delete to the other users and closes the users connection when it finishes.
 	go func() {
 		for {
 			uid := <-deleteUserChan
-
-			for conn := range chatServer.connections {
-				if conn.Locals("uid").(primitive.ObjectID).Hex() != uid {
-					conn.WriteJSON(fiber.Map{
-						"ID":         uid,
-						"event_type": "user_delete",
-					})
-				}
-			}
-
-			//iterate over each chatroom using mongodb cursor, delete rooms owned by the deleted user, and delete messages by the deleted user
-			findOpts := options.Find().SetBatchSize(10)
-			cursor, err := db.RoomCollection.Find(context.TODO(), bson.D{}, findOpts)
+			oid, err := primitive.ObjectIDFromHex(uid)
 			if err != nil {
-				log.Fatal("CURSOR ERR : ", err)
+				continue
 			}
-
-			for cursor.Next(context.TODO()) {
-				var doc models.Room
-				err := cursor.Decode(&doc)
-				if err != nil {
-					log.Fatal("ERROR DECODING : ", err)
-				}
-				for _, m := range doc.Messages {
-					if m.Uid == uid {
-						db.AttachmentCollection.DeleteOne(context.TODO(), bson.M{"_id": m.ID})
-					}
-				}
-				//delete rooms. cannot use deleteMany because the room image needs to be deleted too.
-				if doc.Author.Hex() == uid {
-					db.RoomCollection.DeleteOne(context.TODO(), bson.M{"_id": doc.ID})
-					db.RoomImageCollection.DeleteOne(context.TODO(), bson.M{"_id": doc.ID})
-				} else {
-					//delete users messages in room. chatgpt for pipeline.
-					pipeline := bson.D{
-						{Key: "$set", Value: bson.D{
-							{Key: "messages", Value: bson.A{
-								bson.D{
-									{Key: "$filter", Value: bson.D{
-										{Key: "input", Value: "$messages"},
-										{Key: "as", Value: "m"},
-										{Key: "cond", Value: bson.D{
-											{Key: "$ne", Value: bson.A{"$$m.uid", uid}},
-										}},
-									}},
-								},
-							}},
-						}},
-					}
-					db.RoomCollection.UpdateOne(context.TODO(), bson.M{"_id": doc.ID}, pipeline)
-				}
-				//delete users pfp
-				db.PfpCollection.DeleteOne(context.TODO(), bson.M{"_id": doc.ID})
+			if err := scheduleAccountCleanup(context.TODO(), oid); err != nil {
+				log.Println("Account deletion schedule error : ", err)
 			}
-
-			removeChatServerConnByUID <- uid
 		}
 	}()
+	go watchAccountDeletions(chatServer, removeChatServerConnByUID)
 
 	/* ------------------ Delete message channel ------------------ */
 	go func() {
 		for {
 			rm := <-deleteMsgChan
-			db.AttachmentCollection.DeleteOne(context.TODO(), bson.M{"_id": rm.MessageId})
+			//the replies of a thread go with it, they can't be reached without the parent
+			deletedIds := []primitive.ObjectID{rm.MessageId}
+			var parentId *primitive.ObjectID
+			if room, msg, err := findRoomMessage(context.TODO(), rm.RoomId, rm.MessageId); err == nil {
+				if msg.ParentID != nil {
+					parentId = msg.ParentID
+				} else {
+					for _, m := range room.Messages {
+						if m.ParentID != nil && *m.ParentID == rm.MessageId {
+							deletedIds = append(deletedIds, m.ID)
+						}
+					}
+				}
+			}
+			storage.DeleteAttachments(context.TODO(), deletedIds)
 			db.RoomCollection.UpdateByID(context.TODO(), rm.RoomId, bson.M{
 				"$pull": bson.M{
-					"messages": bson.M{"_id": rm.MessageId},
+					"messages": bson.M{"$or": bson.A{
+						bson.M{"_id": rm.MessageId},
+						bson.M{"parent_id": rm.MessageId},
+					}},
 				},
 			})
-			for r := range chatServer.chatRooms {
-				if chatServer.chatRooms[r].roomId == rm.RoomId.Hex() {
-					for connUid := range chatServer.chatRooms[r].connectionsByUid {
-						defer func() {
-							if r := recover(); r != nil {
-								log.Println("Recovered from panic: ", r)
-							}
-						}()
-						chatServer.chatRooms[r].connectionsByUid[connUid].WriteJSON(fiber.Map{
-							"event_type": "message_delete",
-							"ID":         rm.MessageId.Hex(),
-						})
-					}
+			//thread replies are only sent to the users viewing the thread, the room gets the new thread summary
+			if parentId != nil {
+				if err := updateThreadSummary(context.TODO(), rm.RoomId, *parentId); err != nil {
+					log.Println("Thread summary update error : ", err)
 				}
+				sendToThread(chatServer, rm.RoomId.Hex(), parentId.Hex(), fiber.Map{
+					"event_type": "message_delete",
+					"ID":         rm.MessageId.Hex(),
+				})
+				sendThreadUpdate(chatServer, rm.RoomId, *parentId)
+				continue
+			}
+			sendToRoom(chatServer, rm.RoomId.Hex(), fiber.Map{
+				"event_type": "message_delete",
+				"ID":         rm.MessageId.Hex(),
+			})
+			for _, id := range deletedIds[1:] {
+				sendToThread(chatServer, rm.RoomId.Hex(), rm.MessageId.Hex(), fiber.Map{
+					"event_type": "message_delete",
+					"ID":         id.Hex(),
+				})
 			}
 		}
 	}()
@@ -300,8 +316,14 @@ func NewServer() (*ChatServer, chan string, chan *websocket.Conn, chan string, c
 					connections,
 					connectionsByUid,
 					roomId,
+					make(map[string]map[*websocket.Conn]bool),
 				})
 			}
+			sendToRoomExcept(chatServer, c.id, c.uid, fiber.Map{
+				"event_type": "room_join",
+				"uid":        c.uid,
+				"room_id":    c.id,
+			})
 		}
 	}()
 	/* ------------------ Unregister room connection channel ------------------ */
@@ -314,11 +336,47 @@ func NewServer() (*ChatServer, chan string, chan *websocket.Conn, chan string, c
 				if chatServer.chatRooms[i].roomId == c.id {
 					delete(chatServer.chatRooms[i].connections, conn)
 					delete(chatServer.chatRooms[i].connectionsByUid, c.uid)
+					removeFromThreads(chatServer.chatRooms[i], conn)
 				}
 			}
+			sendRoomLeave(chatServer, c.id, c.uid)
 		}
 	}()
 
+	/* ------------------ Register thread connection channel ------------------ */
+	go func() {
+		for {
+			t := <-chatServer.registerThreadConn
+			for i := range chatServer.chatRooms {
+				if chatServer.chatRooms[i].roomId == t.roomId && chatServer.chatRooms[i].connections[t.conn] {
+					//a connection can only view one thread at a time
+					removeFromThreads(chatServer.chatRooms[i], t.conn)
+					if chatServer.chatRooms[i].threadConnections[t.parentId] == nil {
+						chatServer.chatRooms[i].threadConnections[t.parentId] = make(map[*websocket.Conn]bool)
+					}
+					chatServer.chatRooms[i].threadConnections[t.parentId][t.conn] = true
+				}
+			}
+		}
+	}()
+	/* ------------------ Unregister thread connection channel ------------------ */
+	go func() {
+		for {
+			t := <-chatServer.unregisterThreadConn
+			for i := range chatServer.chatRooms {
+				if chatServer.chatRooms[i].roomId == t.roomId {
+					removeFromThreads(chatServer.chatRooms[i], t.conn)
+				}
+			}
+		}
+	}()
+
+	/* ------------------ Typing indicators ------------------ */
+	go watchTyping(chatServer)
+
+	/* ------------------ Presence ------------------ */
+	go watchPresence(chatServer)
+
 	return chatServer, removeChatServerConnByUID, removeChatServerConn, deleteUserChan, deleteMsgChan, nil
 }
 
@@ -355,6 +413,7 @@ func HandleWsConn(chatServer *ChatServer, removeChatServerConn chan *websocket.C
 	return websocket.New(func(c *websocket.Conn) {
 		chatServer.registerConn <- c
 		log.Println("Ws conn for ", c.Locals("uid").(primitive.ObjectID).Hex())
+		chatServer.presenceChan <- PresenceEvent{uid: c.Locals("uid").(primitive.ObjectID).Hex(), kind: "connect"}
 		for {
 			log.Println("Socket event")
 			var Msg models.MessageEvent
@@ -362,6 +421,46 @@ func HandleWsConn(chatServer *ChatServer, removeChatServerConn chan *websocket.C
 				log.Println("Read err")
 				break
 			}
+			if Msg.EventType == "presence_away" {
+				chatServer.presenceChan <- PresenceEvent{uid: c.Locals("uid").(primitive.ObjectID).Hex(), kind: "away"}
+				continue
+			}
+			chatServer.presenceChan <- PresenceEvent{uid: c.Locals("uid").(primitive.ObjectID).Hex(), kind: "activity"}
+			switch Msg.EventType {
+			case "message_edit", "message_delete":
+				handleMessageCommand(chatServer, c, Msg)
+				continue
+			case "reaction_add", "reaction_remove":
+				handleReactionCommand(chatServer, c, Msg)
+				continue
+			case "thread_join", "thread_leave":
+				handleThreadCommand(chatServer, c, Msg)
+				continue
+			case "read_ack":
+				handleReadAck(chatServer, c, Msg)
+				continue
+			case "typing_start", "typing_stop":
+				handleTypingCommand(chatServer, c, Msg)
+				continue
+			}
+			//sending a message means the user has stopped typing
+			handleTypingCommand(chatServer, c, models.MessageEvent{EventType: "typing_stop"})
+			if Msg.ParentID != "" {
+				//thread replies only go to the users viewing the thread, not the whole room
+				handleThreadReply(chatServer, c, Msg)
+				continue
+			}
+			var replyTo *models.QuotedMessage
+			if Msg.ReplyTo != "" {
+				var err error
+				if replyTo, err = quoteMessage(context.TODO(), roomIdForConn(chatServer, c), Msg.ReplyTo); err != nil {
+					c.WriteJSON(fiber.Map{
+						"event_type": "chatroom_err",
+						"content":    messageErrorText(err),
+					})
+					continue
+				}
+			}
 			msgId := primitive.NewObjectID()
 			chatServer.inbound <- InboundMessage{
 				WsConn:            c,
@@ -370,6 +469,7 @@ func HandleWsConn(chatServer *ChatServer, removeChatServerConn chan *websocket.C
 				ID:                msgId,
 				HasAttachment:     Msg.HasAttachment,
 				AttachmentPending: Msg.HasAttachment,
+				ReplyTo:           replyTo,
 			}
 			// Find room and write message to db
 			for i := range chatServer.chatRooms {
@@ -393,8 +493,10 @@ func HandleWsConn(chatServer *ChatServer, removeChatServerConn chan *websocket.C
 							ID:                msgId,
 							HasAttachment:     Msg.HasAttachment,
 							AttachmentPending: Msg.HasAttachment,
+							ReplyTo:           replyTo,
 						}
 						db.RoomCollection.UpdateOne(context.TODO(), bson.M{"_id": oid}, bson.M{"$push": bson.M{"messages": msg}})
+						notifyMentions(chatServer, oid, msg)
 					}
 				}
 			}
@@ -407,34 +509,188 @@ func HandleWsConn(chatServer *ChatServer, removeChatServerConn chan *websocket.C
 
 /* ------------------ HTTP API ROUTES ------------------ */
 
+const maxRoomsPageSize = 100
+const maxTags = 5
+const maxTagLength = 20
+
+var tagRegex = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// lowercase and dedupe the tags, and check there aren't too many. tags can only use letters, numbers and dashes.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength || !tagRegex.MatchString(tag) {
+			return nil, fmt.Errorf("Tags can only have letters, numbers and dashes, max %d characters", maxTagLength)
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("A room can only have %d tags", maxTags)
+	}
+	return normalized, nil
+}
+
+// Get the room list. Filters are ?own=true, ?search= (room name) and ?tag=. ?sort= can be activity (default),
+// members or created, newest/largest first. If ?limit= is given the list is paginated and the cursor for the
+// next page is in the X-Next-Cursor header, pass it back as ?cursor=. ?summary=true leaves out the messages.
 func HandleGetRooms(c *fiber.Ctx) error {
-	var rooms []models.Room
+	uid := c.Locals("uid").(primitive.ObjectID)
 	var findFilter bson.M = bson.M{}
 	if c.Query("own") == "true" {
-		findFilter = bson.M{"author_id": c.Locals("uid").(primitive.ObjectID)}
+		findFilter["author_id"] = uid
+	}
+	if search := strings.TrimSpace(c.Query("search")); search != "" {
+		findFilter["name"] = bson.M{"$regex": regexp.QuoteMeta(search), "$options": "i"}
+	}
+	if tag := strings.ToLower(strings.TrimSpace(c.Query("tag"))); tag != "" {
+		findFilter["tags"] = tag
+	}
+
+	var sortValue interface{}
+	switch c.Query("sort", "activity") {
+	case "activity":
+		sortValue = bson.M{"$toLong": "$last_activity"}
+	case "members":
+		sortValue = bson.M{"$toLong": "$member_count"}
+	case "created":
+		sortValue = bson.M{"$toLong": "$created_at"}
+	default:
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Invalid sort, use activity, members or created",
+		})
+	}
+
+	limit := 0
+	if c.Query("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > maxRoomsPageSize {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid limit",
+			})
+		}
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": findFilter},
+		bson.M{"$addFields": bson.M{
+			"last_activity": bson.M{"$ifNull": bson.A{bson.M{"$max": "$messages.timestamp"}, "$created_at"}},
+			//the same members as roomMembers, message uids are hex strings so the ids are turned into strings to match
+			"member_count": bson.M{"$size": bson.M{"$setUnion": bson.A{
+				"$messages.uid",
+				bson.A{bson.M{"$toString": "$author_id"}},
+				bson.M{"$map": bson.M{"input": bson.M{"$ifNull": bson.A{"$moderators", bson.A{}}}, "in": bson.M{"$toString": "$$this"}}},
+			}}},
+			"message_count": bson.M{"$size": "$messages"},
+		}},
+		bson.M{"$addFields": bson.M{"sort_value": sortValue}},
+	}
+	//the cursor is the sort value and id of the last room on the previous page
+	if c.Query("cursor") != "" {
+		var cursorValue int64
+		var cursorId primitive.ObjectID
+		parts := strings.SplitN(c.Query("cursor"), "_", 2)
+		err := fmt.Errorf("Invalid cursor")
+		if len(parts) == 2 {
+			if cursorValue, err = strconv.ParseInt(parts[0], 10, 64); err == nil {
+				cursorId, err = primitive.ObjectIDFromHex(parts[1])
+			}
+		}
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid cursor",
+			})
+		}
+		pipeline = append(pipeline, bson.M{"$match": bson.M{"$or": bson.A{
+			bson.M{"sort_value": bson.M{"$lt": cursorValue}},
+			bson.M{"sort_value": cursorValue, "_id": bson.M{"$lt": cursorId}},
+		}}})
+	}
+	pipeline = append(pipeline, bson.M{"$sort": bson.D{{Key: "sort_value", Value: -1}, {Key: "_id", Value: -1}}})
+	if limit > 0 {
+		//one extra to know if there is another page
+		pipeline = append(pipeline, bson.M{"$limit": limit + 1})
 	}
-	cur, err := db.RoomCollection.Find(c.Context(), findFilter)
+	summary := c.Query("summary") == "true"
+	if summary {
+		//only keep what is needed to count unread messages
+		pipeline = append(pipeline, bson.M{"$set": bson.M{"messages": bson.M{"$map": bson.M{
+			"input": "$messages",
+			"in":    bson.M{"_id": "$$this._id", "uid": "$$this.uid", "parent_id": "$$this.parent_id"},
+		}}}})
+	}
+
+	cur, err := db.RoomCollection.Aggregate(c.Context(), pipeline)
 	if err != nil {
 		c.Status(fiber.StatusInternalServerError)
 		return c.JSON(fiber.Map{
 			"message": "Internal error",
 		})
 	}
-	for cur.Next(context.TODO()) {
-		var elem models.Room
-		err := cur.Decode(&elem)
-		if err != nil {
-			log.Fatal(err)
-		}
-		rooms = append(rooms, elem)
+	var entries []struct {
+		models.Room  `bson:",inline"`
+		LastActivity primitive.DateTime `bson:"last_activity"`
+		MemberCount  int                `bson:"member_count"`
+		MessageCount int                `bson:"message_count"`
+		SortValue    int64              `bson:"sort_value"`
+	}
+	if err := cur.All(c.Context(), &entries); err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
 	}
-	if err := cur.Err(); err != nil {
-		log.Fatal(err)
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		c.Set("X-Next-Cursor", fmt.Sprintf("%d_%s", last.SortValue, last.ID.Hex()))
+	}
+
+	rooms := []models.Room{}
+	for _, entry := range entries {
+		prepareRoomForClient(&entry.Room, uid)
+		rooms = append(rooms, entry.Room)
+	}
+	if err := countUnread(c.Context(), rooms, uid); err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
 	}
-	cur.Close(context.TODO())
 
 	c.Status(fiber.StatusOK)
-	return c.JSON(rooms)
+	if !summary {
+		return c.JSON(rooms)
+	}
+	summaries := []models.RoomSummary{}
+	for i, entry := range entries {
+		summaries = append(summaries, models.RoomSummary{
+			ID:           entry.ID,
+			Name:         entry.Name,
+			Author:       entry.Author,
+			CreatedAt:    entry.CreatedAt,
+			UpdatedAt:    entry.UpdatedAt,
+			ImgBlur:      entry.ImgBlur,
+			ImgBlurHash:  entry.ImgBlurHash,
+			Tags:         entry.Tags,
+			LastActivity: entry.LastActivity,
+			MessageCount: entry.MessageCount,
+			MemberCount:  entry.MemberCount,
+			UnreadCount:  rooms[i].UnreadCount,
+			MentionCount: rooms[i].MentionCount,
+		})
+	}
+	return c.JSON(summaries)
 }
 
 func HandleGetRoom(c *fiber.Ctx) error {
@@ -462,6 +718,8 @@ func HandleGetRoom(c *fiber.Ctx) error {
 		}
 	}
 
+	prepareRoomForClient(&room, c.Locals("uid").(primitive.ObjectID))
+
 	c.Status(fiber.StatusOK)
 	return c.JSON(room)
 }
@@ -485,10 +743,9 @@ func HandleGetRoomImage(c *fiber.Ctx) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	var img models.RoomImage
-	found := db.RoomImageCollection.FindOne(ctx, bson.M{"_id": oid})
-	if found.Err() != nil {
-		if found.Err() != mongo.ErrNoDocuments {
+	img, err := storage.RoomImages.Get(ctx, oid)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
 			c.Status(fiber.StatusInternalServerError)
 			return c.JSON(fiber.Map{
 				"message": "Internal error",
@@ -500,10 +757,9 @@ func HandleGetRoomImage(c *fiber.Ctx) error {
 			})
 		}
 	}
-	found.Decode(&img)
 	c.Status(fiber.StatusOK)
-	c.Type("image/jpeg")
-	return c.Send(img.Binary.Data)
+	c.Set("Content-Type", imaging.MimeType(img))
+	return c.Send(img)
 }
 
 func HandleCreateRoom(chatServer *ChatServer) fiber.Handler {
@@ -515,6 +771,13 @@ func HandleCreateRoom(chatServer *ChatServer) fiber.Handler {
 				"message": "Invalid request",
 			})
 		}
+		tags, err := normalizeTags(body.Tags)
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": err.Error(),
+			})
+		}
 
 		found := db.RoomCollection.FindOne(c.Context(), bson.M{"author_id": c.Locals("uid").(primitive.ObjectID), "name": bson.M{"$regex": body.Name, "$options": "i"}})
 		if found.Err() != nil {
@@ -532,11 +795,13 @@ func HandleCreateRoom(chatServer *ChatServer) fiber.Handler {
 		}
 
 		res, err := db.RoomCollection.InsertOne(c.Context(), models.Room{
-			Name:      body.Name,
-			CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
-			UpdatedAt: primitive.NewDateTimeFromTime(time.Now()),
-			Author:    c.Locals("uid").(primitive.ObjectID),
-			Messages:  []models.Message{},
+			Name:       body.Name,
+			CreatedAt:  primitive.NewDateTimeFromTime(time.Now()),
+			UpdatedAt:  primitive.NewDateTimeFromTime(time.Now()),
+			Author:     c.Locals("uid").(primitive.ObjectID),
+			Messages:   []models.Message{},
+			Moderators: []primitive.ObjectID{},
+			Tags:       tags,
 		})
 
 		if err != nil {
@@ -552,6 +817,7 @@ func HandleCreateRoom(chatServer *ChatServer) fiber.Handler {
 					"ID":         res.InsertedID.(primitive.ObjectID).Hex(),
 					"name":       body.Name,
 					"author_id":  c.Locals("uid").(primitive.ObjectID).Hex(),
+					"tags":       tags,
 					"event_type": "chatroom_update",
 				})
 			}
@@ -564,11 +830,12 @@ func HandleCreateRoom(chatServer *ChatServer) fiber.Handler {
 			"created_at": primitive.NewDateTimeFromTime(time.Now()),
 			"updated_at": primitive.NewDateTimeFromTime(time.Now()),
 			"author_id":  c.Locals("uid").(primitive.ObjectID).Hex(),
+			"tags":       tags,
 		})
 	}
 }
 
-// Updates the room name only
+// Updates the room name, and the tags if they are in the body
 func HandleUpdateRoom(protectedRids *map[primitive.ObjectID]struct{}, chatServer *ChatServer) func(*fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 		var rids = *protectedRids
@@ -605,6 +872,16 @@ func HandleUpdateRoom(protectedRids *map[primitive.ObjectID]struct{}, chatServer
 			})
 		}
 
+		var tags []string
+		if body.Tags != nil {
+			if tags, err = normalizeTags(body.Tags); err != nil {
+				c.Status(fiber.StatusBadRequest)
+				return c.JSON(fiber.Map{
+					"message": err.Error(),
+				})
+			}
+		}
+
 		foundRoomsCursor, err := db.RoomCollection.Find(c.Context(), bson.M{"author_id": c.Locals("uid").(primitive.ObjectID), "name": bson.M{"$regex": body.Name, "$options": "i"}})
 		if err != nil {
 			if err != mongo.ErrNoDocuments {
@@ -652,73 +929,138 @@ func HandleUpdateRoom(protectedRids *map[primitive.ObjectID]struct{}, chatServer
 			}
 		}
 
-		db.RoomCollection.UpdateByID(c.Context(), oid, bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: body.Name}}}})
+		update := bson.D{{Key: "name", Value: body.Name}}
+		if tags != nil {
+			update = append(update, bson.E{Key: "tags", Value: tags})
+		}
+		db.RoomCollection.UpdateByID(c.Context(), oid, bson.D{{Key: "$set", Value: update}})
 
 		for conn := range chatServer.connections {
 			if conn.Locals("uid").(primitive.ObjectID) != c.Locals("uid").(primitive.ObjectID) {
-				conn.WriteJSON(fiber.Map{
+				data := fiber.Map{
 					"ID":   oid.Hex(),
 					"name": body.Name,
-				})
+				}
+				if tags != nil {
+					data["tags"] = tags
+				}
+				conn.WriteJSON(data)
 			}
 		}
 
 		c.Status(fiber.StatusOK)
 		return c.JSON(fiber.Map{
-			"message": "Room name updated",
+			"message": "Room updated",
 		})
 	}
 }
 
-const maxAttachmentSize = 20 * 1024 * 1024 //20mb
+const maxAttachmentSize = 500 * 1024 * 1024     //500mb
+const maxImageAttachmentSize = 20 * 1024 * 1024 //20mb, images are decoded in memory to be resized
+
+var errImageTooLarge = errors.New("Image too large. Max 20mb.")
 
-func attachmentError(c *fiber.Ctx, msgId string, roomId string, chatServer *ChatServer) error {
+// Mark one of the message's attachments as failed and tell the clients in the room
+func markAttachmentError(ctx context.Context, chatServer *ChatServer, roomId primitive.ObjectID, msgId primitive.ObjectID, attachmentId primitive.ObjectID) {
 	// Emit attachment error message to clients in room
 	for r := range chatServer.chatRooms {
-		if chatServer.chatRooms[r].roomId == roomId {
+		if chatServer.chatRooms[r].roomId == roomId.Hex() {
 			for connUid := range chatServer.chatRooms[r].connectionsByUid {
 				chatServer.chatRooms[r].connectionsByUid[connUid].WriteJSON(fiber.Map{
-					"event_type": "attachment_error",
-					"ID":         msgId,
+					"event_type":    "attachment_error",
+					"ID":            msgId.Hex(),
+					"attachment_id": attachmentId.Hex(),
 				})
 			}
 		}
 	}
 	// Update msg in db
-	db.RoomCollection.UpdateByID(c.Context(), roomId, []bson.M{
-		{
-			"$set": bson.M{
-				"messages": bson.M{
-					"$map": bson.M{
-						"input": "$messages",
-						"as":    "message",
-						"in": bson.M{
-							"$cond": bson.M{
-								"if": bson.M{
-									"$eq": []interface{}{"$$message._id", msgId},
-								},
-								"then": bson.M{
-									"$mergeObjects": []interface{}{
-										"$$message",
-										bson.M{
-											"attachment_error": true,
-										},
-									},
-								},
-								"else": "$$message",
-							},
-						},
-					},
-				},
-			},
-		},
-	})
+	updateMessageAttachment(ctx, roomId, msgId, attachmentId, bson.M{"status": attachmentStatusError})
+}
+
+func attachmentError(c *fiber.Ctx, msgId primitive.ObjectID, roomId primitive.ObjectID, attachmentId primitive.ObjectID, chatServer *ChatServer) error {
+	markAttachmentError(c.Context(), chatServer, roomId, msgId, attachmentId)
 	c.Status(fiber.StatusInternalServerError)
 	return c.JSON(fiber.Map{
 		"message": "Internal error",
 	})
 }
 
+// Save the file as one of the message's attachments, which has to have been added with addMessageAttachment,
+// then update the message and tell the clients in the room. Returns errImageTooLarge or an error from
+// imaging.Process if the image can't be used, before anything is saved.
+func saveAttachment(ctx context.Context, chatServer *ChatServer, roomId primitive.ObjectID, msgId primitive.ObjectID, attachmentId primitive.ObjectID, filename string, src io.ReadSeeker, size int64) (*models.MessageAttachment, error) {
+	//the type comes from the files contents, the Content-Type header sent by the client can't be trusted
+	attachment_type, err := sniffContentType(src)
+	if err != nil {
+		return nil, err
+	}
+	imageFormat, err := imaging.DetectReader(src)
+	if err != nil {
+		return nil, err
+	}
+	if imageFormat != "" && size > maxImageAttachmentSize {
+		return nil, errImageTooLarge
+	}
+
+	attachment := &models.MessageAttachment{
+		ID:       attachmentId,
+		Name:     filename,
+		Size:     size,
+		MimeType: attachment_type,
+		Status:   attachmentStatusComplete,
+	}
+	if imageFormat != "" {
+		/* ----- Save file as resized image, which can be a different format to the original. The smaller sizes are made from it when they're first asked for ----- */
+		img, err := imaging.Process(src, imaging.Full.MaxWidth)
+		if err != nil {
+			return nil, err
+		}
+		attachment.BlurHash = img.BlurHash
+		attachment.Size = int64(len(img.Data))
+		attachment.MimeType = img.MimeType
+		attachment.Width = img.Width
+		attachment.Height = img.Height
+		if err := storage.PutAttachment(ctx, attachmentId, msgId, filename, img.MimeType, bytes.NewReader(img.Data), attachment.Size); err != nil {
+			return nil, err
+		}
+	} else {
+		/* ----- Save file as misc downloadable file, streamed from the temporary file ----- */
+		if err := storage.PutAttachment(ctx, attachmentId, msgId, filename, attachment_type, src, size); err != nil {
+			return nil, err
+		}
+	}
+
+	//the file can't be saved inside a transaction so it goes in first, and is deleted again if the message
+	//can't be updated. if the server stops in between the file is removed by the orphan reconciliation.
+	if err := updateMessageAttachment(ctx, roomId, msgId, attachmentId, bson.M{
+		"size":      attachment.Size,
+		"mime_type": attachment.MimeType,
+		"width":     attachment.Width,
+		"height":    attachment.Height,
+		"status":    attachment.Status,
+	}); err != nil {
+		storage.DeleteAttachmentFiles(ctx, []primitive.ObjectID{attachmentId})
+		return nil, err
+	}
+
+	// Emit attachment complete message to clients in room
+	for r := range chatServer.chatRooms {
+		if chatServer.chatRooms[r].roomId == roomId.Hex() {
+			for connUid := range chatServer.chatRooms[r].connectionsByUid {
+				chatServer.chatRooms[r].connectionsByUid[connUid].WriteJSON(fiber.Map{
+					"event_type":      "attachment_complete",
+					"attachment_type": attachment.MimeType,
+					"ID":              msgId.Hex(),
+					"attachment":      attachment,
+				})
+			}
+		}
+	}
+	return attachment, nil
+}
+
+// Add a file to the message's attachments. Send the message with has_attachment first, then upload each file.
 func HandleUploadAttachment(chatServer *ChatServer) func(*fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 
@@ -733,7 +1075,7 @@ func HandleUploadAttachment(chatServer *ChatServer) func(*fiber.Ctx) error {
 		if file.Size > maxAttachmentSize {
 			c.Status(fiber.StatusBadRequest)
 			return c.JSON(fiber.Map{
-				"message": "File too large. Max 20mb.",
+				"message": "File too large. Max 500mb.",
 			})
 		}
 
@@ -760,143 +1102,35 @@ func HandleUploadAttachment(chatServer *ChatServer) func(*fiber.Ctx) error {
 			})
 		}
 
-		var room models.Room
-		foundRoom := db.RoomCollection.FindOne(c.Context(), bson.M{"_id": roomId})
-		if foundRoom.Err() != nil {
-			if foundRoom.Err() == mongo.ErrNoDocuments {
-				c.Status(fiber.StatusNotFound)
-				return c.JSON(fiber.Map{
-					"message": "Room not found",
-				})
-			} else {
-				c.Status(fiber.StatusInternalServerError)
-				return c.JSON(fiber.Map{
-					"message": "Internal error",
-				})
-			}
-		}
-		foundRoom.Decode(&room)
-
-		var foundMsg bool
-		for _, msg := range room.Messages {
-			if msg.ID == msgId {
-				foundMsg = true
-			}
+		if err := checkCanAddAttachment(c.Context(), roomId, msgId, c.Locals("uid").(primitive.ObjectID)); err != nil {
+			return messageCommandErrorResponse(c, err)
 		}
-		if !foundMsg {
-			c.Status(fiber.StatusNotFound)
-			return c.JSON(fiber.Map{
-				"message": "Message not found",
-			})
+		attachment, err := addMessageAttachment(c.Context(), chatServer, roomId, msgId, file.Filename, file.Size)
+		if err != nil {
+			return messageCommandErrorResponse(c, err)
 		}
 
+		//large files are in a temporary file on disk at this point, not in memory
 		src, err := file.Open()
 		if err != nil {
-			attachmentError(c, msgId.Hex(), roomId.Hex(), chatServer)
-		}
-
-		foundAttach := db.AttachmentCollection.FindOne(c.Context(), bson.M{"_id": msgId})
-		if foundAttach.Err() == nil {
-			c.Status(fiber.StatusBadRequest)
-			return c.JSON(fiber.Map{
-				"message": "Attachment already exists",
-			})
-		}
-		var isJPEG, isPNG bool
-		isJPEG = file.Header.Get("Content-Type") == "image/jpeg"
-		isPNG = file.Header.Get("Content-Type") == "image/png"
-		attachment_type := file.Header.Get("Content-Type")
-		if isJPEG || isPNG {
-			//make it image/jpeg because even if the original file was a png it gets converted to jpeg
-			attachment_type = "image/jpeg"
-		}
-		if isJPEG || isPNG {
-			/* ----- Save file to db as resized image ----- */
-			var img image.Image
-			var decodeErr error
-			if isJPEG {
-				img, decodeErr = jpeg.Decode(src)
-			}
-			if isPNG {
-				img, decodeErr = png.Decode(src)
-			}
-			if decodeErr != nil {
-				attachmentError(c, msgId.Hex(), roomId.Hex(), chatServer)
-			}
-			buf := &bytes.Buffer{}
-			width := math.Min(float64(img.Bounds().Dx()), 350)
-			img = resize.Resize(uint(width), 0, img, resize.Lanczos2)
-			if err := jpeg.Encode(buf, img, nil); err != nil {
-				attachmentError(c, msgId.Hex(), roomId.Hex(), chatServer)
-			}
-			db.AttachmentCollection.InsertOne(c.Context(), models.Attachment{
-				ID:       msgId,
-				Binary:   primitive.Binary{Data: buf.Bytes()},
-				MimeType: attachment_type,
-			})
-		}
-		if !isJPEG && !isPNG {
-			/* ----- Save file to db as misc downloadable file (no video player) ----- */
-			data, err := ioutil.ReadAll(src)
-			if err != nil {
-				attachmentError(c, msgId.Hex(), roomId.Hex(), chatServer)
-			}
-			db.AttachmentCollection.InsertOne(c.Context(), models.Attachment{
-				ID:       msgId,
-				Binary:   primitive.Binary{Data: data},
-				MimeType: attachment_type,
-			})
+			return attachmentError(c, msgId, roomId, attachment.ID, chatServer)
 		}
-		src.Close()
-
-		/*I used chatgpt to help me figure this out... it got stuff wrong, had to correct it */
-		db.RoomCollection.UpdateByID(c.Context(), roomId, []bson.M{
-			{
-				"$set": bson.M{
-					"messages": bson.M{
-						"$map": bson.M{
-							"input": "$messages",
-							"as":    "message",
-							"in": bson.M{
-								"$cond": bson.M{
-									"if": bson.M{
-										"$eq": []interface{}{"$$message._id", msgId},
-									},
-									"then": bson.M{
-										"$mergeObjects": []interface{}{
-											"$$message",
-											bson.M{
-												"has_attachment":     true,
-												"attachment_pending": false,
-												"attachment_type":    attachment_type,
-											},
-										},
-									},
-									"else": "$$message",
-								},
-							},
-						},
-					},
-				},
-			},
-		})
+		defer src.Close()
 
-		// Emit attachment complete message to clients in room
-		for r := range chatServer.chatRooms {
-			if chatServer.chatRooms[r].roomId == roomId.Hex() {
-				for connUid := range chatServer.chatRooms[r].connectionsByUid {
-					chatServer.chatRooms[r].connectionsByUid[connUid].WriteJSON(fiber.Map{
-						"event_type":      "attachment_complete",
-						"attachment_type": attachment_type,
-						"ID":              msgId.Hex(),
-					})
-				}
+		saved, err := saveAttachment(c.Context(), chatServer, roomId, msgId, attachment.ID, file.Filename, src, file.Size)
+		if err != nil {
+			if isImageError(err) {
+				markAttachmentError(c.Context(), chatServer, roomId, msgId, attachment.ID)
+				return imageErrorResponse(c, err)
 			}
+			return attachmentError(c, msgId, roomId, attachment.ID, chatServer)
 		}
 
 		c.Status(fiber.StatusCreated)
+		signAttachmentLinks(saved, c.Locals("uid").(primitive.ObjectID))
 		return c.JSON(fiber.Map{
-			"message": "Attachment created",
+			"message":    "Attachment created",
+			"attachment": saved,
 		})
 	}
 }
@@ -936,9 +1170,183 @@ func HandleGetAttachmentAsImage(c *fiber.Ctx) error {
 		}
 	}
 	found.Decode(&img)
+	if err := checkAttachmentAccess(c, &img); err != nil {
+		return messageCommandErrorResponse(c, err)
+	}
+	sized, err := attachmentOfSize(c, &img)
+	if err != nil {
+		return attachmentSizeErrorResponse(c, err)
+	}
 	c.Status(fiber.StatusOK)
-	c.Type("image/jpeg")
-	return c.Send(img.Binary.Data)
+	c.Set("Content-Type", sized.Metadata.MimeType)
+	c.Set("X-Content-Type-Options", "nosniff")
+	return sendAttachmentStream(c, sized)
+}
+
+// image types that can be made smaller
+var resizableAttachmentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var errInvalidAttachmentSize = errors.New("Invalid size, use thumb, medium or full")
+var errAttachmentNotResizable = errors.New("Only images have other sizes")
+
+// The attachment in the size asked for with ?size=thumb or ?size=medium, the smaller sizes are made the first time
+// they're asked for. The attachment is given back as it is if no size, or full, was asked for.
+func attachmentOfSize(c *fiber.Ctx, attachment *models.Attachment) (*models.Attachment, error) {
+	name := c.Query("size")
+	if name == "" || name == imaging.Full.Name {
+		return attachment, nil
+	}
+	size, ok := imaging.DerivativeSize(name)
+	if !ok {
+		return nil, errInvalidAttachmentSize
+	}
+	if !resizableAttachmentTypes[attachment.Metadata.MimeType] {
+		return nil, errAttachmentNotResizable
+	}
+	return storage.AttachmentDerivative(c.Context(), attachment, size)
+}
+
+func attachmentSizeErrorResponse(c *fiber.Ctx, err error) error {
+	switch err {
+	case errInvalidAttachmentSize, errAttachmentNotResizable:
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": err.Error(),
+		})
+	case mongo.ErrNoDocuments:
+		c.Status(fiber.StatusNotFound)
+		return c.JSON(fiber.Map{
+			"message": "Attachment not found",
+		})
+	}
+	c.Status(fiber.StatusInternalServerError)
+	return c.JSON(fiber.Map{
+		"message": "Internal error",
+	})
+}
+
+// errors from an image that can't be used, which are the clients fault
+func isImageError(err error) bool {
+	switch err {
+	case errImageTooLarge, imaging.ErrUnsupportedFormat, imaging.ErrInvalidImage, imaging.ErrTooManyPixels:
+		return true
+	}
+	return false
+}
+
+func imageErrorResponse(c *fiber.Ctx, err error) error {
+	if isImageError(err) {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": err.Error(),
+		})
+	}
+	c.Status(fiber.StatusInternalServerError)
+	return c.JSON(fiber.Map{
+		"message": "Internal error",
+	})
+}
+
+// Work out the mime type from the first 512 bytes of the file, then go back to the start
+func sniffContentType(src io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// Parse a Range header with a single range of bytes. Other units and multiple ranges aren't supported, ok is
+// false for those and for malformed headers so the whole file is sent instead, which is allowed. An error means
+// the range is outside of the file.
+func parseRange(header string, size int64) (start int64, length int64, ok bool, err error) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, size, false, nil
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(strings.TrimPrefix(header, "bytes=")), "-")
+	if !found {
+		return 0, size, false, nil
+	}
+	if first == "" {
+		//suffix range, the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, size, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < start {
+			return 0, size, false, nil
+		}
+		if e < end {
+			end = e
+		}
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end - start + 1, true, nil
+}
+
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// Stream the attachment from GridFS or the blob store to the client, it's never all held in memory. Range requests get back
+// 206 Partial Content with only the bytes asked for, so media can be seeked and downloads can be resumed.
+func sendAttachmentStream(c *fiber.Ctx, attachment *models.Attachment) error {
+	c.Set("Accept-Ranges", "bytes")
+	lastModified := attachment.UploadDate.Time().UTC().Format(http.TimeFormat)
+	c.Set("Last-Modified", lastModified)
+
+	start, length := int64(0), attachment.Length
+	//If-Range means only send part of the file if it hasn't changed since the client got the rest of it
+	if header := c.Get("Range"); header != "" && (c.Get("If-Range") == "" || c.Get("If-Range") == lastModified) {
+		var ok bool
+		var err error
+		start, length, ok, err = parseRange(header, attachment.Length)
+		if err != nil {
+			c.Set("Content-Range", fmt.Sprintf("bytes */%d", attachment.Length))
+			c.Status(fiber.StatusRequestedRangeNotSatisfiable)
+			return c.JSON(fiber.Map{
+				"message": "Range not satisfiable",
+			})
+		}
+		if ok {
+			c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, attachment.Length))
+			c.Status(fiber.StatusPartialContent)
+		}
+	}
+
+	stream, err := storage.OpenAttachment(c.Context(), attachment, start, length)
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	//fiber closes the stream when it's done sending it
+	return c.SendStream(stream, int(length))
 }
 
 func HandleDownloadAttachment(c *fiber.Ctx) error {
@@ -965,15 +1373,99 @@ func HandleDownloadAttachment(c *fiber.Ctx) error {
 				"message": "Attachment not found",
 			})
 		}
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
 	}
 
 	var attachment models.Attachment
 	found.Decode(&attachment)
+	if err := checkAttachmentAccess(c, &attachment); err != nil {
+		return messageCommandErrorResponse(c, err)
+	}
 
 	c.Status(fiber.StatusOK)
-	c.Response().Header.Set("Content-Type", attachment.MimeType)
+	c.Response().Header.Set("Content-Type", attachment.Metadata.MimeType)
 	c.Response().Header.Set("Content-Disposition", "attachment")
-	return c.Send(attachment.Binary.Data)
+	c.Response().Header.Set("X-Content-Type-Options", "nosniff")
+	return sendAttachmentStream(c, &attachment)
+}
+
+// media types that can't run scripts, so they are safe for the browser to show on the page. these are the types
+// http.DetectContentType gives back for them, which is how the type of an attachment is found when it's uploaded.
+var inlineAttachmentTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"audio/mpeg":      true,
+	"audio/wave":      true,
+	"audio/aiff":      true,
+	"audio/basic":     true,
+	"audio/midi":      true,
+	"application/ogg": true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/avi":       true,
+}
+
+// Serve the attachment to be shown in the browser (for video and audio players), only for safe media types.
+// Anything else has to be downloaded. Images can be asked for in a smaller size with ?size=thumb or ?size=medium.
+// Like the other attachment endpoints it needs a signed link or the session of a member of the room.
+func HandleViewAttachment(c *fiber.Ctx) error {
+	if c.Params("id") == "" {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Bad request",
+		})
+	}
+
+	oid, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Invalid ID",
+		})
+	}
+
+	var attachment models.Attachment
+	if err := db.AttachmentCollection.FindOne(c.Context(), bson.M{"_id": oid}).Decode(&attachment); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(fiber.StatusNotFound)
+			return c.JSON(fiber.Map{
+				"message": "Attachment not found",
+			})
+		}
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+
+	if err := checkAttachmentAccess(c, &attachment); err != nil {
+		return messageCommandErrorResponse(c, err)
+	}
+
+	if !inlineAttachmentTypes[attachment.Metadata.MimeType] {
+		c.Status(fiber.StatusUnsupportedMediaType)
+		return c.JSON(fiber.Map{
+			"message": "This attachment can't be viewed, download it instead",
+		})
+	}
+
+	sized, err := attachmentOfSize(c, &attachment)
+	if err != nil {
+		return attachmentSizeErrorResponse(c, err)
+	}
+
+	c.Status(fiber.StatusOK)
+	c.Response().Header.Set("Content-Type", sized.Metadata.MimeType)
+	c.Response().Header.Set("Content-Disposition", "inline")
+	c.Response().Header.Set("X-Content-Type-Options", "nosniff")
+	c.Response().Header.Set("Content-Security-Policy", "sandbox")
+	return sendAttachmentStream(c, sized)
 }
 
 const maxRoomImageSize = 20 * 1024 * 1024 //20mb
@@ -995,13 +1487,6 @@ func HandleUploadRoomImage(chatServer *ChatServer) func(*fiber.Ctx) error {
 			})
 		}
 
-		if !strings.HasPrefix(file.Header.Get("Content-Type"), "image/") {
-			c.Status(fiber.StatusBadRequest)
-			return c.JSON(fiber.Map{
-				"message": "File is not an image",
-			})
-		}
-
 		if c.Params("id") == "" {
 			c.Status(fiber.StatusBadRequest)
 			return c.JSON(fiber.Map{
@@ -1047,71 +1532,63 @@ func HandleUploadRoomImage(chatServer *ChatServer) func(*fiber.Ctx) error {
 		}
 		defer src.Close()
 
-		var img image.Image
-		var blurImg image.Image
-		var decodeErr error
-		if file.Header.Get("Content-Type") == "image/jpeg" {
-			img, decodeErr = jpeg.Decode(src)
-		} else if file.Header.Get("Content-Type") == "image/png" {
-			img, decodeErr = png.Decode(src)
-		} else {
-			c.Status(fiber.StatusBadRequest)
-			return c.JSON(fiber.Map{
-				"message": "Unrecognized / unsupported format",
-			})
+		img, err := imaging.Process(src, 350)
+		if err != nil {
+			return imageErrorResponse(c, err)
 		}
-		if decodeErr != nil {
+		blurImg := resize.Resize(6, 2, img.Preview, resize.Lanczos2)
+		blurBuf := &bytes.Buffer{}
+		if err := jpeg.Encode(blurBuf, blurImg, nil); err != nil {
 			c.Status(fiber.StatusInternalServerError)
 			return c.JSON(fiber.Map{
 				"message": "Internal error",
 			})
 		}
 
-		img = resize.Resize(350, 0, img, resize.Lanczos2)
-		blurImg = resize.Resize(6, 2, img, resize.Lanczos2)
-		buf := &bytes.Buffer{}
-		blurBuf := &bytes.Buffer{}
-		if err := jpeg.Encode(buf, img, nil); err != nil {
+		imgBlurB64 := "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(blurBuf.Bytes())
+
+		//the blob can't be written inside the transaction so it's uploaded first, and the old one is only released
+		//once the new one is saved
+		key, err := storage.PutBytes(c.Context(), img.Data)
+		if err != nil {
 			c.Status(fiber.StatusInternalServerError)
 			return c.JSON(fiber.Map{
 				"message": "Internal error",
 			})
 		}
-		if err := jpeg.Encode(blurBuf, blurImg, nil); err != nil {
+		//the image and the blur on the room are saved together so they always match
+		var oldKey string
+		err = db.WithTransaction(c.Context(), func(ctx context.Context) error {
+			var err error
+			if oldKey, err = storage.RoomImages.Set(ctx, roomId, key); err != nil {
+				return err
+			}
+			_, err = db.RoomCollection.UpdateByID(ctx, roomId, bson.M{"$set": bson.M{"img_blur": imgBlurB64, "img_blurhash": img.BlurHash}})
+			return err
+		})
+		if err != nil {
+			storage.Release(c.Context(), key)
 			c.Status(fiber.StatusInternalServerError)
 			return c.JSON(fiber.Map{
 				"message": "Internal error",
 			})
 		}
-
-		count, err := db.RoomImageCollection.CountDocuments(c.Context(), bson.M{"_id": roomId})
-		if count != 0 {
-			db.RoomImageCollection.UpdateByID(c.Context(), roomId, bson.M{"$set": bson.M{"binary": primitive.Binary{Data: buf.Bytes()}}})
-		} else {
-			db.RoomImageCollection.InsertOne(c.Context(), models.RoomImage{
-				ID:     roomId,
-				Binary: primitive.Binary{Data: buf.Bytes()},
-			})
-		}
-
-		imgBlurB64 := "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(blurBuf.Bytes())
-
-		db.RoomCollection.UpdateByID(c.Context(), roomId, bson.M{"img_blur": imgBlurB64})
+		storage.Release(c.Context(), oldKey)
 
 		//send the updated chatroom image to all users through websocket api
 		for conn := range chatServer.connections {
 			if conn.Locals("uid").(primitive.ObjectID) != c.Locals("uid").(primitive.ObjectID) {
 				conn.WriteJSON(fiber.Map{
-					"ID":         roomId.Hex(),
-					"img_url":    "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
-					"img_blur":   imgBlurB64,
-					"event_type": "chatroom_update",
+					"ID":           roomId.Hex(),
+					"img_url":      imaging.DataURL(img.Data),
+					"img_blur":     imgBlurB64,
+					"img_blurhash": img.BlurHash,
+					"event_type":   "chatroom_update",
 				})
 			}
 		}
 
 		//clear the buffer. garbage collection does this automatically but this might be a little faster
-		buf = nil
 		blurBuf = nil
 
 		c.Status(fiber.StatusOK)
@@ -1174,24 +1651,46 @@ func HandleDeleteRoom(chatServer *ChatServer, protectedRids *map[primitive.Objec
 			}
 		}
 
+		msgIds := []primitive.ObjectID{}
 		for _, m := range room.Messages {
-			db.AttachmentCollection.DeleteOne(c.Context(), bson.M{"_id": m.ID})
-		}
-
-		res, err := db.RoomCollection.DeleteOne(c.Context(), bson.M{"_id": oid})
-		db.RoomImageCollection.DeleteOne(c.Context(), bson.M{"_id": oid})
+			msgIds = append(msgIds, m.ID)
+		}
+		var deleted int64
+		var blobKeys []string
+		//without transactions the room is deleted last, so if something fails the room can still be deleted again.
+		//anything left behind is cleaned up by the orphan reconciliation.
+		err = db.WithTransaction(c.Context(), func(ctx context.Context) error {
+			keys, err := storage.RemoveAttachments(ctx, msgIds)
+			if err != nil {
+				return err
+			}
+			imgKey, err := storage.RoomImages.Remove(ctx, oid)
+			if err != nil {
+				return err
+			}
+			res, err := db.RoomCollection.DeleteOne(ctx, bson.M{"_id": oid})
+			if err != nil {
+				return err
+			}
+			deleted = res.DeletedCount
+			blobKeys = append(keys, imgKey)
+			return nil
+		})
 
-		if res.DeletedCount == 0 {
-			c.Status(fiber.StatusBadRequest)
+		if err != nil {
+			c.Status(fiber.StatusInternalServerError)
 			return c.JSON(fiber.Map{
-				"message": "Bad request",
+				"message": "Internal error",
 			})
 		}
 
-		if err != nil {
-			c.Status(fiber.StatusInternalServerError)
+		//the blobs are only released once the documents pointing to them are gone for good
+		storage.Release(c.Context(), blobKeys...)
+
+		if deleted == 0 {
+			c.Status(fiber.StatusBadRequest)
 			return c.JSON(fiber.Map{
-				"message": "Internal error",
+				"message": "Bad request",
 			})
 		}
 
@@ -1246,6 +1745,8 @@ func HandleJoinRoom(chatServer *ChatServer) func(*fiber.Ctx) error {
 
 		chatServer.registerRoomConn <- ChatRoomConnectionRegistration{id: c.Params("id"), uid: c.Locals("uid").(primitive.ObjectID).Hex()}
 
+		prepareRoomForClient(&room, c.Locals("uid").(primitive.ObjectID))
+
 		c.Status(fiber.StatusOK)
 		return c.JSON(room)
 	}
@@ -0,0 +1,45 @@
+package controllers
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header        string
+		size          int64
+		start, length int64
+		ok            bool
+		err           error
+	}{
+		//no range or one that isn't supported, the whole file is sent
+		{"", 100, 0, 100, false, nil},
+		{"items=0-10", 100, 0, 100, false, nil},
+		{"bytes=0-10,20-30", 100, 0, 100, false, nil},
+		{"bytes=10", 100, 0, 100, false, nil},
+		{"bytes=a-10", 100, 0, 100, false, nil},
+		{"bytes=10-b", 100, 0, 100, false, nil},
+		{"bytes=20-10", 100, 0, 100, false, nil},
+		{"bytes=--5", 100, 0, 100, false, nil},
+		//ranges
+		{"bytes=0-0", 100, 0, 1, true, nil},
+		{"bytes=0-99", 100, 0, 100, true, nil},
+		{"bytes=10-19", 100, 10, 10, true, nil},
+		{"bytes=10-", 100, 10, 90, true, nil},
+		{"bytes= 10-19 ", 100, 10, 10, true, nil},
+		{"bytes=90-1000", 100, 90, 10, true, nil},
+		//suffix ranges, the last n bytes
+		{"bytes=-10", 100, 90, 10, true, nil},
+		{"bytes=-1000", 100, 0, 100, true, nil},
+		//past the end
+		{"bytes=100-", 100, 0, 0, false, errRangeNotSatisfiable},
+		{"bytes=150-200", 100, 0, 0, false, errRangeNotSatisfiable},
+		{"bytes=-0", 100, 0, 0, false, errRangeNotSatisfiable},
+		{"bytes=-10", 0, 0, 0, false, errRangeNotSatisfiable},
+	}
+	for _, test := range tests {
+		start, length, ok, err := parseRange(test.header, test.size)
+		if start != test.start || length != test.length || ok != test.ok || err != test.err {
+			t.Errorf("parseRange(%q, %d) = %d, %d, %v, %v, want %d, %d, %v, %v", test.header, test.size,
+				start, length, ok, err, test.start, test.length, test.ok, test.err)
+		}
+	}
+}
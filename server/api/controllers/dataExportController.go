@@ -0,0 +1,374 @@
+package controllers
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+	"github.com/web-stuff-98/golang-chat-learning-project/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const dataExportExpiry = 24 * time.Hour    //how long the download link works for
+const dataExportTimeout = 30 * time.Minute //pending exports older than this are assumed to have died with the server
+
+const (
+	dataExportPending = "pending"
+	dataExportReady   = "ready"
+	dataExportFailed  = "failed"
+)
+
+func dataExportURL(export *models.DataExport) string {
+	return fmt.Sprintf("/api/user/export/%v/download?token=%v", export.ID.Hex(), export.Token)
+}
+
+func dataExportJSON(export *models.DataExport) fiber.Map {
+	data := fiber.Map{
+		"ID":         export.ID.Hex(),
+		"status":     export.Status,
+		"created_at": export.CreatedAt,
+		"expires_at": export.ExpiresAt,
+	}
+	if export.Status == dataExportReady {
+		data["url"] = dataExportURL(export)
+	}
+	return data
+}
+
+func writeExportFile(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func writeExportJSON(zw *zip.Writer, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeExportFile(zw, name, data)
+}
+
+// write everything held about the user to the zip. profile.json, pfp.jpg, rooms.json with the rooms they own,
+// rooms/<room id>.jpg, messages.json with every message they sent and attachments/<attachment id>.
+func writeDataExport(ctx context.Context, zw *zip.Writer, uid primitive.ObjectID) error {
+	var user models.User
+	if err := db.UserCollection.FindOne(ctx, bson.M{"_id": uid}).Decode(&user); err != nil {
+		return err
+	}
+	if err := writeExportJSON(zw, "profile.json", fiber.Map{
+		"ID":                  user.ID.Hex(),
+		"username":            user.Username,
+		"share_read_receipts": user.ShareReadReceipts,
+		"last_seen":           user.LastSeen,
+	}); err != nil {
+		return err
+	}
+	if pfp, err := storage.Pfps.Get(ctx, uid); err == nil {
+		if err := writeExportFile(zw, "pfp.jpg", pfp); err != nil {
+			return err
+		}
+	} else if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	cursor, err := db.RoomCollection.Find(ctx, bson.M{"author_id": uid}, options.Find().SetProjection(bson.M{"messages": 0}))
+	if err != nil {
+		return err
+	}
+	var owned []models.Room
+	if err := cursor.All(ctx, &owned); err != nil {
+		return err
+	}
+	rooms := []fiber.Map{}
+	for _, room := range owned {
+		rooms = append(rooms, fiber.Map{
+			"ID":         room.ID.Hex(),
+			"name":       room.Name,
+			"created_at": room.CreatedAt,
+			"updated_at": room.UpdatedAt,
+			"moderators": room.Moderators,
+			"tags":       room.Tags,
+		})
+		if img, err := storage.RoomImages.Get(ctx, room.ID); err == nil {
+			if err := writeExportFile(zw, "rooms/"+room.ID.Hex()+".jpg", img); err != nil {
+				return err
+			}
+		} else if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	if err := writeExportJSON(zw, "rooms.json", rooms); err != nil {
+		return err
+	}
+
+	cursor, err = db.RoomCollection.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"messages.uid": uid.Hex()}},
+		bson.M{"$project": bson.M{"name": 1, "messages": 1}},
+		bson.M{"$unwind": "$messages"},
+		bson.M{"$match": bson.M{"messages.uid": uid.Hex()}},
+	})
+	if err != nil {
+		return err
+	}
+	var unwound []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Name     string             `bson:"name"`
+		Messages models.Message     `bson:"messages"`
+	}
+	if err := cursor.All(ctx, &unwound); err != nil {
+		return err
+	}
+	messages := []fiber.Map{}
+	for _, u := range unwound {
+		messages = append(messages, fiber.Map{
+			"room_id":   u.ID.Hex(),
+			"room_name": u.Name,
+			"message":   u.Messages,
+		})
+		if !u.Messages.HasAttachment {
+			continue
+		}
+		attachments, err := storage.FindAttachments(ctx, []primitive.ObjectID{u.Messages.ID})
+		if err != nil {
+			return err
+		}
+		for _, attachment := range attachments {
+			//streamed from GridFS or the blob store into the zip
+			stream, err := storage.OpenAttachment(ctx, &attachment, 0, -1)
+			if err != nil {
+				return err
+			}
+			w, err := zw.Create("attachments/" + attachment.ID.Hex())
+			if err == nil {
+				_, err = io.Copy(w, stream)
+			}
+			stream.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writeExportJSON(zw, "messages.json", messages)
+}
+
+// build the zip into GridFS, then tell the user over the websocket that it's ready or that it failed
+func runDataExport(chatServer *ChatServer, export models.DataExport) {
+	err := func() error {
+		bucket, err := db.ExportBucket()
+		if err != nil {
+			return err
+		}
+		stream, err := bucket.OpenUploadStreamWithID(export.ID, "data-export-"+export.Uid.Hex()+".zip")
+		if err != nil {
+			return err
+		}
+		zw := zip.NewWriter(stream)
+		if err := writeDataExport(context.TODO(), zw, export.Uid); err != nil {
+			stream.Abort()
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			stream.Abort()
+			return err
+		}
+		return stream.Close()
+	}()
+
+	update := bson.M{}
+	if err != nil {
+		log.Println("Data export error : ", err)
+		export.Status = dataExportFailed
+		update["status"] = dataExportFailed
+	} else {
+		tokenBytes := make([]byte, 32)
+		rand.Read(tokenBytes)
+		export.Status = dataExportReady
+		export.Token = hex.EncodeToString(tokenBytes)
+		export.ExpiresAt = primitive.NewDateTimeFromTime(time.Now().Add(dataExportExpiry))
+		update["status"] = dataExportReady
+		update["token"] = export.Token
+		update["expires_at"] = export.ExpiresAt
+	}
+	db.DataExportCollection.UpdateByID(context.TODO(), export.ID, bson.M{"$set": update})
+
+	if conn, ok := chatServer.connectionsByUid[export.Uid.Hex()]; ok {
+		data := dataExportJSON(&export)
+		data["event_type"] = "data_export_" + export.Status
+		conn.WriteJSON(data)
+	}
+}
+
+// delete exports and their files, used for expired exports and when the user is deleted
+func DeleteDataExports(ctx context.Context, filter bson.M) error {
+	cursor, err := db.DataExportCollection.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	var exports []models.DataExport
+	if err := cursor.All(ctx, &exports); err != nil {
+		return err
+	}
+	bucket, err := db.ExportBucket()
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		if err := bucket.DeleteContext(ctx, export.ID); err != nil && err != gridfs.ErrFileNotFound {
+			return err
+		}
+		if _, err := db.DataExportCollection.DeleteOne(ctx, bson.M{"_id": export.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start exporting the users data. When it's done a data_export_ready event with the download link is sent
+// over the websocket. If an export is already being made that one is returned instead.
+func HandleRequestDataExport(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uid := c.Locals("uid").(primitive.ObjectID)
+
+		var pending models.DataExport
+		err := db.DataExportCollection.FindOne(c.Context(), bson.M{
+			"uid":        uid,
+			"status":     dataExportPending,
+			"created_at": bson.M{"$gt": primitive.NewDateTimeFromTime(time.Now().Add(-dataExportTimeout))},
+		}).Decode(&pending)
+		if err == nil {
+			c.Status(fiber.StatusAccepted)
+			return c.JSON(dataExportJSON(&pending))
+		}
+		if err != mongo.ErrNoDocuments {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+
+		//only the newest export is kept
+		if err := DeleteDataExports(c.Context(), bson.M{"uid": uid}); err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+		export := models.DataExport{
+			ID:        primitive.NewObjectID(),
+			Uid:       uid,
+			Status:    dataExportPending,
+			CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+			ExpiresAt: primitive.NewDateTimeFromTime(time.Now().Add(dataExportExpiry)),
+		}
+		if _, err := db.DataExportCollection.InsertOne(c.Context(), export); err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+
+		go runDataExport(chatServer, export)
+
+		c.Status(fiber.StatusAccepted)
+		return c.JSON(dataExportJSON(&export))
+	}
+}
+
+// Get the status of the users newest data export, with the download link if it's ready
+func HandleGetDataExport(c *fiber.Ctx) error {
+	var export models.DataExport
+	err := db.DataExportCollection.FindOne(c.Context(), bson.M{"uid": c.Locals("uid").(primitive.ObjectID)}, options.FindOne().SetSort(bson.M{"created_at": -1})).Decode(&export)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(fiber.StatusNotFound)
+			return c.JSON(fiber.Map{
+				"message": "You have no data export",
+			})
+		}
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	if export.Status == dataExportPending && export.CreatedAt.Time().Before(time.Now().Add(-dataExportTimeout)) {
+		export.Status = dataExportFailed
+	}
+
+	c.Status(fiber.StatusOK)
+	return c.JSON(dataExportJSON(&export))
+}
+
+// Download a data export zip using the link from data_export_ready
+func HandleDownloadDataExport(c *fiber.Ctx) error {
+	exportId, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil || c.Query("token") == "" {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Bad request",
+		})
+	}
+
+	var export models.DataExport
+	if err := db.DataExportCollection.FindOne(c.Context(), bson.M{
+		"_id":    exportId,
+		"uid":    c.Locals("uid").(primitive.ObjectID),
+		"token":  c.Query("token"),
+		"status": dataExportReady,
+	}).Decode(&export); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(fiber.StatusNotFound)
+			return c.JSON(fiber.Map{
+				"message": "Export not found",
+			})
+		}
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	if export.ExpiresAt.Time().Before(time.Now()) {
+		c.Status(fiber.StatusGone)
+		return c.JSON(fiber.Map{
+			"message": "This download link has expired",
+		})
+	}
+
+	bucket, err := db.ExportBucket()
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	stream, err := bucket.OpenDownloadStream(exportId)
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+
+	c.Status(fiber.StatusOK)
+	c.Type("zip")
+	c.Set("Content-Disposition", "attachment; filename=\"data-export.zip\"")
+	//fiber closes the stream when it's done sending it
+	return c.SendStream(stream, int(stream.GetFile().Length))
+}
@@ -0,0 +1,441 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/api/validator"
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	errRoomNotFound    = errors.New("Room not found")
+	errMessageNotFound = errors.New("Message not found")
+	errNotAllowed      = errors.New("Unauthorized")
+	errEmptyMessage    = errors.New("You cannot submit an empty message")
+	errMessageTooLong  = errors.New("Message too long. Max 200 characters")
+)
+
+// send an event to every connection viewing the room
+func sendToRoom(chatServer *ChatServer, roomId string, data interface{}) {
+	for r := range chatServer.chatRooms {
+		if chatServer.chatRooms[r].roomId == roomId {
+			for conn := range chatServer.chatRooms[r].connections {
+				conn.WriteJSON(data)
+			}
+		}
+	}
+}
+
+// get the id of the room a websocket connection is currently in, returns an empty string if not in a room
+func roomIdForConn(chatServer *ChatServer, c *websocket.Conn) string {
+	for i := range chatServer.chatRooms {
+		if chatServer.chatRooms[i].connections[c] {
+			return chatServer.chatRooms[i].roomId
+		}
+	}
+	return ""
+}
+
+// the author of a room is always a moderator
+func isRoomModerator(room *models.Room, uid primitive.ObjectID) bool {
+	if room.Author == uid {
+		return true
+	}
+	for _, id := range room.Moderators {
+		if id == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// thread replies are left out of the room timeline (they are loaded from the thread endpoint), reactions are counted
+// and the links to attachments are signed for the user if they are a member
+func prepareRoomForClient(room *models.Room, uid primitive.ObjectID) {
+	//members are worked out before the replies are left out, users who only replied in threads are members too
+	members := roomMembers(room)
+	timeline := make([]models.Message, 0, len(room.Messages))
+	for _, m := range room.Messages {
+		if m.ParentID == nil {
+			timeline = append(timeline, m)
+		}
+	}
+	room.Messages = timeline
+	summarizeReactions(room.Messages, uid)
+	signMessageAttachments(room.Messages, members, uid)
+}
+
+// find a room and the message inside it
+func findRoomMessage(ctx context.Context, roomId primitive.ObjectID, msgId primitive.ObjectID) (*models.Room, *models.Message, error) {
+	var room models.Room
+	if err := db.RoomCollection.FindOne(ctx, bson.M{"_id": roomId}).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil, errRoomNotFound
+		}
+		return nil, nil, err
+	}
+	for i := range room.Messages {
+		if room.Messages[i].ID == msgId {
+			return &room, &room.Messages[i], nil
+		}
+	}
+	return &room, nil, errMessageNotFound
+}
+
+const maxQuoteLength = 100 //quoted content is cut down to this many characters
+
+// cut message content down for quotes and notifications
+func truncateContent(content string) string {
+	runes := []rune(content)
+	if len(runes) > maxQuoteLength {
+		runes = append(runes[:maxQuoteLength-1], '…')
+	}
+	return string(runes)
+}
+
+// take a snapshot of a message in the room to store with a reply
+func quoteMessage(ctx context.Context, roomIdHex string, msgIdHex string) (*models.QuotedMessage, error) {
+	roomId, err := primitive.ObjectIDFromHex(roomIdHex)
+	if err != nil {
+		return nil, errRoomNotFound
+	}
+	msgId, err := primitive.ObjectIDFromHex(msgIdHex)
+	if err != nil {
+		return nil, errMessageNotFound
+	}
+	_, msg, err := findRoomMessage(ctx, roomId, msgId)
+	if err != nil {
+		return nil, err
+	}
+	return &models.QuotedMessage{
+		ID:        msg.ID,
+		Uid:       msg.Uid,
+		Content:   truncateContent(msg.Content),
+		Timestamp: msg.Timestamp,
+	}, nil
+}
+
+func validateMessageContent(content string) error {
+	if content == "" {
+		return errEmptyMessage
+	}
+	if len(content) > 200 {
+		return errMessageTooLong
+	}
+	return nil
+}
+
+// edit is restricted to the author of the message or a moderator of the room. the old content is pushed to the edit history.
+func editMessage(ctx context.Context, chatServer *ChatServer, roomId primitive.ObjectID, msgId primitive.ObjectID, uid primitive.ObjectID, content string) error {
+	if err := validateMessageContent(content); err != nil {
+		return err
+	}
+	room, msg, err := findRoomMessage(ctx, roomId, msgId)
+	if err != nil {
+		return err
+	}
+	if msg.Uid != uid.Hex() && !isRoomModerator(room, uid) {
+		return errNotAllowed
+	}
+
+	//the previous version was written when the message was last edited, or when it was sent if it was never edited
+	prevTimestamp := msg.Timestamp
+	if msg.EditedAt != 0 {
+		prevTimestamp = msg.EditedAt
+	}
+	editedAt := primitive.NewDateTimeFromTime(time.Now())
+	res, err := db.RoomCollection.UpdateOne(ctx, bson.M{"_id": roomId, "messages._id": msgId}, bson.M{
+		"$set": bson.M{
+			"messages.$.content":   content,
+			"messages.$.edited_at": editedAt,
+		},
+		"$push": bson.M{
+			"messages.$.edits": models.MessageEdit{
+				Content:   msg.Content,
+				Timestamp: prevTimestamp,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		//the message was deleted in between finding it and updating it
+		return errMessageNotFound
+	}
+
+	edit := fiber.Map{
+		"event_type": "message_edit",
+		"ID":         msgId.Hex(),
+		"content":    content,
+		"edited_at":  editedAt,
+	}
+	//replies are only sent to the users viewing their thread, editing one doesn't change the thread summary
+	if msg.ParentID != nil {
+		sendToThread(chatServer, roomId.Hex(), msg.ParentID.Hex(), edit)
+	} else {
+		sendToRoom(chatServer, roomId.Hex(), edit)
+	}
+	return nil
+}
+
+// delete is restricted to the author of the message or a moderator of the room. the message_delete event is sent from the delete message channel.
+func deleteMessage(ctx context.Context, chatServer *ChatServer, roomId primitive.ObjectID, msgId primitive.ObjectID, uid primitive.ObjectID) error {
+	room, msg, err := findRoomMessage(ctx, roomId, msgId)
+	if err != nil {
+		return err
+	}
+	if msg.Uid != uid.Hex() && !isRoomModerator(room, uid) {
+		return errNotAllowed
+	}
+	chatServer.deleteMsgChan <- RoomIdMessageId{
+		RoomId:    roomId,
+		MessageId: msgId,
+	}
+	return nil
+}
+
+// get the status code for an error from a message command. anything that isn't one of the errors above is an internal error.
+func messageErrorStatus(err error) int {
+	switch err {
+	case errRoomNotFound, errMessageNotFound:
+		return fiber.StatusNotFound
+	case errNotAllowed, errInvalidAttachmentLink:
+		return fiber.StatusUnauthorized
+	case errNotRoomMember:
+		return fiber.StatusForbidden
+	case errEmptyMessage, errMessageTooLong, errInvalidEmoji, errTooManyReactions, errNestedThread, errAlreadyPinned, errNotPinned,
+		errNoAttachments, errAttachmentExists, errTooManyAttachments:
+		return fiber.StatusBadRequest
+	}
+	return fiber.StatusInternalServerError
+}
+
+func messageErrorText(err error) string {
+	if messageErrorStatus(err) == fiber.StatusInternalServerError {
+		return "Internal error"
+	}
+	return err.Error()
+}
+
+func messageCommandErrorResponse(c *fiber.Ctx, err error) error {
+	c.Status(messageErrorStatus(err))
+	return c.JSON(fiber.Map{
+		"message": messageErrorText(err),
+	})
+}
+
+// handle the message_edit and message_delete websocket commands. the message must be in the room the connection is in.
+func handleMessageCommand(chatServer *ChatServer, c *websocket.Conn, ev models.MessageEvent) {
+	roomId, err := primitive.ObjectIDFromHex(roomIdForConn(chatServer, c))
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "You are not in a room",
+		})
+		return
+	}
+	msgId, err := primitive.ObjectIDFromHex(ev.ID)
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "Invalid message ID",
+		})
+		return
+	}
+	uid := c.Locals("uid").(primitive.ObjectID)
+	if ev.EventType == "message_edit" {
+		err = editMessage(context.TODO(), chatServer, roomId, msgId, uid, ev.Content)
+	} else {
+		err = deleteMessage(context.TODO(), chatServer, roomId, msgId, uid)
+	}
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    messageErrorText(err),
+		})
+	}
+}
+
+func parseRoomAndMessageIds(c *fiber.Ctx) (primitive.ObjectID, primitive.ObjectID, error) {
+	roomId, err := primitive.ObjectIDFromHex(c.Params("roomId"))
+	if err != nil {
+		return primitive.NilObjectID, primitive.NilObjectID, err
+	}
+	msgId, err := primitive.ObjectIDFromHex(c.Params("msgId"))
+	if err != nil {
+		return primitive.NilObjectID, primitive.NilObjectID, err
+	}
+	return roomId, msgId, nil
+}
+
+func HandleEditMessage(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, msgId, err := parseRoomAndMessageIds(c)
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+
+		var body validator.MessageUpdate
+		if err := c.BodyParser(&body); err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Bad request",
+			})
+		}
+
+		if err := editMessage(c.Context(), chatServer, roomId, msgId, c.Locals("uid").(primitive.ObjectID), body.Content); err != nil {
+			return messageCommandErrorResponse(c, err)
+		}
+
+		c.Status(fiber.StatusOK)
+		return c.JSON(fiber.Map{
+			"message": "Message updated",
+		})
+	}
+}
+
+func HandleDeleteMessage(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, msgId, err := parseRoomAndMessageIds(c)
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+
+		if err := deleteMessage(c.Context(), chatServer, roomId, msgId, c.Locals("uid").(primitive.ObjectID)); err != nil {
+			return messageCommandErrorResponse(c, err)
+		}
+
+		c.Status(fiber.StatusOK)
+		return c.JSON(fiber.Map{
+			"message": "Message deleted",
+		})
+	}
+}
+
+// Get the previous versions of a message, for users who can see the room it's in
+func HandleGetMessageHistory(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, msgId, err := parseRoomAndMessageIds(c)
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+
+		room, msg, err := findRoomMessage(c.Context(), roomId, msgId)
+		if err != nil {
+			return messageCommandErrorResponse(c, err)
+		}
+		if !canViewRoom(chatServer, room, c.Locals("uid").(primitive.ObjectID)) {
+			return messageCommandErrorResponse(c, errNotAllowed)
+		}
+
+		edits := msg.Edits
+		if edits == nil {
+			edits = []models.MessageEdit{}
+		}
+		c.Status(fiber.StatusOK)
+		return c.JSON(edits)
+	}
+}
+
+// Add or remove a room moderator. Only the author of the room can do this.
+func HandleSetModerator(protectedRids *map[primitive.ObjectID]struct{}, add bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var rids = *protectedRids
+
+		roomId, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid room ID",
+			})
+		}
+		uid, err := primitive.ObjectIDFromHex(c.Params("uid"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid user ID",
+			})
+		}
+
+		if _, ok := rids[roomId]; ok {
+			c.Status(fiber.StatusUnauthorized)
+			return c.JSON(fiber.Map{
+				"message": "You cannot modify test rooms.",
+			})
+		}
+
+		var room models.Room
+		if err := db.RoomCollection.FindOne(c.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+			if err == mongo.ErrNoDocuments {
+				c.Status(fiber.StatusNotFound)
+				return c.JSON(fiber.Map{
+					"message": "Room not found",
+				})
+			}
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+		if room.Author != c.Locals("uid").(primitive.ObjectID) {
+			c.Status(fiber.StatusUnauthorized)
+			return c.JSON(fiber.Map{
+				"message": "Unauthorized",
+			})
+		}
+
+		if add {
+			count, err := db.UserCollection.CountDocuments(c.Context(), bson.M{"_id": uid})
+			if err != nil {
+				c.Status(fiber.StatusInternalServerError)
+				return c.JSON(fiber.Map{
+					"message": "Internal error",
+				})
+			}
+			if count == 0 {
+				c.Status(fiber.StatusNotFound)
+				return c.JSON(fiber.Map{
+					"message": "User not found",
+				})
+			}
+			_, err = db.RoomCollection.UpdateByID(c.Context(), roomId, bson.M{"$addToSet": bson.M{"moderators": uid}})
+		} else {
+			_, err = db.RoomCollection.UpdateByID(c.Context(), roomId, bson.M{"$pull": bson.M{"moderators": uid}})
+		}
+		if err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+
+		c.Status(fiber.StatusOK)
+		if add {
+			return c.JSON(fiber.Map{
+				"message": "Moderator added",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Moderator removed",
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const defaultNotificationsPageSize = 30
+const maxNotificationsPageSize = 100
+
+// usernames are max 15 characters. trailing punctuation is trimmed off after matching so "@bob," still works.
+var mentionRegex = regexp.MustCompile(`(?:^|\s)@([^\s@]{1,16})`)
+
+// get the names mentioned in a message, lowercased with duplicates removed
+func parseMentions(content string) []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, match := range mentionRegex.FindAllStringSubmatch(content, -1) {
+		name := strings.ToLower(strings.TrimRight(match[1], ".,!?:;)'\""))
+		if name == "" || len(name) > 15 || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// members of a room are its author, its moderators and anyone who has sent a message in it. anyone can view a room,
+// so viewers are not members.
+func roomMembers(room *models.Room) map[primitive.ObjectID]struct{} {
+	members := make(map[primitive.ObjectID]struct{})
+	members[room.Author] = struct{}{}
+	for _, id := range room.Moderators {
+		members[id] = struct{}{}
+	}
+	for _, m := range room.Messages {
+		if uid, err := primitive.ObjectIDFromHex(m.Uid); err == nil {
+			members[uid] = struct{}{}
+		}
+	}
+	return members
+}
+
+// Users can see what was sent in a room if they are a member of it or are viewing it, which is what fetching
+// the room does
+func canViewRoom(chatServer *ChatServer, room *models.Room, uid primitive.ObjectID) bool {
+	if _, ok := roomMembers(room)[uid]; ok {
+		return true
+	}
+	_, ok := roomViewers(chatServer, room.ID.Hex())[uid]
+	return ok
+}
+
+// users currently viewing the room
+func roomViewers(chatServer *ChatServer, roomId string) map[primitive.ObjectID]struct{} {
+	viewers := make(map[primitive.ObjectID]struct{})
+	for i := range chatServer.chatRooms {
+		if chatServer.chatRooms[i].roomId == roomId {
+			for uidHex := range chatServer.chatRooms[i].connectionsByUid {
+				if uid, err := primitive.ObjectIDFromHex(uidHex); err == nil {
+					viewers[uid] = struct{}{}
+				}
+			}
+		}
+	}
+	return viewers
+}
+
+// Work out who is mentioned in a message that has just been saved, store a notification for each of them and
+// send the mention event to their socket wherever they are. @here notifies users viewing the room, @room notifies
+// every member, @username notifies that user if they are a member of the room or viewing it.
+func notifyMentions(chatServer *ChatServer, roomId primitive.ObjectID, msg models.Message) {
+	names := parseMentions(msg.Content)
+	if len(names) == 0 {
+		return
+	}
+
+	var room models.Room
+	if err := db.RoomCollection.FindOne(context.TODO(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		return
+	}
+	members := roomMembers(&room)
+	viewers := roomViewers(chatServer, roomId.Hex())
+
+	//the same user only gets one notification per message, @username takes priority over @here and @room
+	notifyTypes := make(map[primitive.ObjectID]string)
+	usernames := []string{}
+	for _, name := range names {
+		switch name {
+		case "room":
+			for uid := range members {
+				if _, ok := notifyTypes[uid]; !ok {
+					notifyTypes[uid] = "room"
+				}
+			}
+		case "here":
+			for uid := range viewers {
+				if t, ok := notifyTypes[uid]; !ok || t == "room" {
+					notifyTypes[uid] = "here"
+				}
+			}
+		default:
+			usernames = append(usernames, name)
+		}
+	}
+	if len(usernames) > 0 {
+		//collation strength 2 makes the username match case insensitive
+		cursor, err := db.UserCollection.Find(context.TODO(), bson.M{"username": bson.M{"$in": usernames}}, options.Find().SetCollation(&options.Collation{Locale: "en", Strength: 2}))
+		if err != nil {
+			log.Println("Mention lookup error : ", err)
+			return
+		}
+		for cursor.Next(context.TODO()) {
+			var user models.User
+			if cursor.Decode(&user) != nil {
+				continue
+			}
+			_, isMember := members[user.ID]
+			_, isViewer := viewers[user.ID]
+			if isMember || isViewer {
+				notifyTypes[user.ID] = "mention"
+			}
+		}
+		cursor.Close(context.TODO())
+	}
+
+	for uid, notifyType := range notifyTypes {
+		if uid.Hex() == msg.Uid {
+			continue
+		}
+		notification := models.Notification{
+			ID:        primitive.NewObjectID(),
+			Uid:       uid,
+			Type:      notifyType,
+			RoomID:    roomId,
+			MessageID: msg.ID,
+			AuthorUid: msg.Uid,
+			Content:   truncateContent(msg.Content),
+			CreatedAt: primitive.NewDateTimeFromTime(time.Now()),
+		}
+		if _, err := db.NotificationCollection.InsertOne(context.TODO(), notification); err != nil {
+			log.Println("Notification insert error : ", err)
+			continue
+		}
+		if conn, ok := chatServer.connectionsByUid[uid.Hex()]; ok {
+			conn.WriteJSON(fiber.Map{
+				"event_type": "mention",
+				"ID":         notification.ID.Hex(),
+				"type":       notification.Type,
+				"room_id":    roomId.Hex(),
+				"message_id": msg.ID.Hex(),
+				"author_uid": msg.Uid,
+				"content":    notification.Content,
+				"created_at": notification.CreatedAt,
+			})
+		}
+	}
+}
+
+// Get the users notifications, newest first. ?unread=true for only unread ones, ?before= with the ID of the last notification for the next page.
+func HandleGetNotifications(c *fiber.Ctx) error {
+	filter := bson.M{"uid": c.Locals("uid").(primitive.ObjectID)}
+	if c.Query("unread") == "true" {
+		filter["read"] = false
+	}
+	if c.Query("before") != "" {
+		before, err := primitive.ObjectIDFromHex(c.Query("before"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid cursor",
+			})
+		}
+		filter["_id"] = bson.M{"$lt": before}
+	}
+	limit := defaultNotificationsPageSize
+	if c.Query("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > maxNotificationsPageSize {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid limit",
+			})
+		}
+	}
+
+	cursor, err := db.NotificationCollection.Find(c.Context(), filter, options.Find().SetSort(bson.M{"_id": -1}).SetLimit(int64(limit)))
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	notifications := []models.Notification{}
+	if err := cursor.All(c.Context(), &notifications); err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+
+	unread, err := db.NotificationCollection.CountDocuments(c.Context(), bson.M{"uid": c.Locals("uid").(primitive.ObjectID), "read": false})
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+
+	c.Status(fiber.StatusOK)
+	return c.JSON(fiber.Map{
+		"notifications": notifications,
+		"unread":        unread,
+	})
+}
+
+// Mark a single notification as read, or all of them if there is no id
+func HandleMarkNotificationsRead(c *fiber.Ctx) error {
+	filter := bson.M{"uid": c.Locals("uid").(primitive.ObjectID), "read": false}
+	if c.Params("id") != "" {
+		oid, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+		filter["_id"] = oid
+		err = db.NotificationCollection.FindOne(c.Context(), bson.M{"_id": oid, "uid": c.Locals("uid").(primitive.ObjectID)}).Err()
+		if err == mongo.ErrNoDocuments {
+			c.Status(fiber.StatusNotFound)
+			return c.JSON(fiber.Map{
+				"message": "Notification not found",
+			})
+		} else if err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+	}
+
+	if _, err := db.NotificationCollection.UpdateMany(c.Context(), filter, bson.M{"$set": bson.M{"read": true}}); err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+
+	c.Status(fiber.StatusOK)
+	return c.JSON(fiber.Map{
+		"message": "Marked as read",
+	})
+}
@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{"no mentions here", []string{}},
+		{"@bob hello", []string{"bob"}},
+		{"hello @Bob", []string{"bob"}},
+		{"@bob, @alice! and @carol.", []string{"bob", "alice", "carol"}},
+		{"(@bob)", []string{}},
+		{"@bob @BOB @Bob", []string{"bob"}},
+		{"@here and @room", []string{"here", "room"}},
+		{"email bob@example.com", []string{}},
+		{"@", []string{}},
+		{"@@bob", []string{}},
+		{"line\n@bob", []string{"bob"}},
+		//usernames are max 15 characters, 16 is allowed to match so trailing punctuation can be trimmed
+		{"@abcdefghijklmno", []string{"abcdefghijklmno"}},
+		{"@abcdefghijklmno,", []string{"abcdefghijklmno"}},
+		{"@abcdefghijklmnop", []string{}},
+		{"@abcdefghijklmnopq", []string{}},
+	}
+	for _, test := range tests {
+		got := parseMentions(test.content)
+		if strings.Join(got, ",") != strings.Join(test.want, ",") || len(got) != len(test.want) {
+			t.Errorf("parseMentions(%q) = %q, want %q", test.content, got, test.want)
+		}
+	}
+}
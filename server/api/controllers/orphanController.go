@@ -0,0 +1,158 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// files are only treated as orphans once their owner's id is older than this, so something that is being
+// created while the reconciliation runs isn't deleted before its owner is saved
+const orphanMinAge = time.Hour
+
+// get the set of ids found at path in the collection
+func collectIds(ctx context.Context, collection *mongo.Collection, path string) (map[primitive.ObjectID]bool, error) {
+	ids := make(map[primitive.ObjectID]bool)
+	values, err := collection.Distinct(ctx, path, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range values {
+		if oid, ok := v.(primitive.ObjectID); ok {
+			ids[oid] = true
+		}
+	}
+	return ids, nil
+}
+
+// find the values at path in the collection that aren't in owners, for documents matching filter that are older
+// than orphanMinAge
+func findOrphans(ctx context.Context, collection *mongo.Collection, path string, filter bson.M, owners map[primitive.ObjectID]bool) ([]primitive.ObjectID, error) {
+	cutoff := primitive.NewObjectIDFromTimestamp(time.Now().Add(-orphanMinAge))
+	query := bson.M{"_id": bson.M{"$lt": cutoff}}
+	for k, v := range filter {
+		query[k] = v
+	}
+	values, err := collection.Distinct(ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	orphans := []primitive.ObjectID{}
+	for _, v := range values {
+		if oid, ok := v.(primitive.ObjectID); ok && !owners[oid] {
+			orphans = append(orphans, oid)
+		}
+	}
+	return orphans, nil
+}
+
+// delete the documents in the collection whose id isn't in owners. the ids are also the ids of their owners.
+func deleteOrphans(ctx context.Context, collection *mongo.Collection, owners map[primitive.ObjectID]bool) (int, error) {
+	orphans, err := findOrphans(ctx, collection, "_id", bson.M{}, owners)
+	if err != nil || len(orphans) == 0 {
+		return 0, err
+	}
+	res, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": orphans}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+// Delete attachments, uploads, room images and pfps whose message, room or user no longer exists, and blobs that
+// nothing points to. These get left behind when something fails part way through on a server without transactions,
+// or when an upload is cut off.
+func ReconcileOrphans(ctx context.Context) error {
+	//the owners are found before the files so anything created in between is protected by orphanMinAge
+	msgIds, err := collectIds(ctx, db.RoomCollection, "messages._id")
+	if err != nil {
+		return err
+	}
+	roomIds, err := collectIds(ctx, db.RoomCollection, "_id")
+	if err != nil {
+		return err
+	}
+	uids, err := collectIds(ctx, db.UserCollection, "_id")
+	if err != nil {
+		return err
+	}
+
+	attachmentIds, err := collectIds(ctx, db.RoomCollection, "messages.attachments._id")
+	if err != nil {
+		return err
+	}
+
+	//attachments that aren't in a messages list, and older ones without a list whose message is gone
+	orphanAttachments, err := findOrphans(ctx, db.AttachmentCollection, "_id", bson.M{"metadata.msg_id": bson.M{"$exists": true}}, attachmentIds)
+	if err != nil {
+		return err
+	}
+	orphanLegacyAttachments, err := findOrphans(ctx, db.AttachmentCollection, "_id", bson.M{"metadata.msg_id": bson.M{"$exists": false}}, msgIds)
+	if err != nil {
+		return err
+	}
+	orphanAttachments = append(orphanAttachments, orphanLegacyAttachments...)
+	if err := storage.DeleteAttachmentFiles(ctx, orphanAttachments); err != nil {
+		return err
+	}
+	attachments := len(orphanAttachments)
+	//chunks left behind by uploads that never finished
+	fileIds, err := collectIds(ctx, db.AttachmentCollection, "_id")
+	if err != nil {
+		return err
+	}
+	orphanChunks, err := findOrphans(ctx, db.AttachmentChunkCollection, "files_id", bson.M{}, fileIds)
+	if err != nil {
+		return err
+	}
+	if err := db.DeleteAttachments(ctx, orphanChunks); err != nil {
+		return err
+	}
+	//resumable uploads for messages that were deleted, and chunks of uploads that are gone
+	orphanUploads, err := findOrphans(ctx, db.UploadCollection, "msg_id", bson.M{}, msgIds)
+	if err != nil {
+		return err
+	}
+	if len(orphanUploads) > 0 {
+		if _, err := db.UploadCollection.DeleteMany(ctx, bson.M{"msg_id": bson.M{"$in": orphanUploads}}); err != nil {
+			return err
+		}
+	}
+	uploadIds, err := collectIds(ctx, db.UploadCollection, "_id")
+	if err != nil {
+		return err
+	}
+	orphanUploadChunks, err := findOrphans(ctx, db.UploadChunkCollection, "upload_id", bson.M{}, uploadIds)
+	if err != nil {
+		return err
+	}
+	if len(orphanUploadChunks) > 0 {
+		if _, err := db.UploadChunkCollection.DeleteMany(ctx, bson.M{"upload_id": bson.M{"$in": orphanUploadChunks}}); err != nil {
+			return err
+		}
+	}
+	roomImages, err := deleteOrphans(ctx, db.RoomImageCollection, roomIds)
+	if err != nil {
+		return err
+	}
+	pfps, err := deleteOrphans(ctx, db.PfpCollection, uids)
+	if err != nil {
+		return err
+	}
+	//blobs of the room images and pfps deleted above are found here too, nothing points to them anymore
+	blobs, err := storage.CollectGarbage(ctx, orphanMinAge)
+	if err != nil {
+		return err
+	}
+	if attachments+len(orphanUploads)+roomImages+pfps+blobs > 0 {
+		log.Printf("Deleted orphans : %d attachments, %d uploads, %d room images, %d pfps, %d blobs", attachments, len(orphanUploads), roomImages, pfps, blobs)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const defaultMaxPinnedMessages = 25
+
+var errAlreadyPinned = errors.New("Message is already pinned")
+var errNotPinned = errors.New("Message is not pinned")
+
+// max number of pinned messages in a room, can be changed with the MAX_PINNED_MESSAGES environment variable
+func maxPinnedMessages() int {
+	if max, err := strconv.Atoi(os.Getenv("MAX_PINNED_MESSAGES")); err == nil && max > 0 {
+		return max
+	}
+	return defaultMaxPinnedMessages
+}
+
+// Pin or unpin a message. Only moderators of the room can do this.
+func HandleSetPinned(chatServer *ChatServer, pin bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, msgId, err := parseRoomAndMessageIds(c)
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+
+		uid := c.Locals("uid").(primitive.ObjectID)
+		room, msg, err := findRoomMessage(c.Context(), roomId, msgId)
+		if err != nil {
+			return messageCommandErrorResponse(c, err)
+		}
+		if !isRoomModerator(room, uid) {
+			return messageCommandErrorResponse(c, errNotAllowed)
+		}
+		if pin && msg.Pinned {
+			return messageCommandErrorResponse(c, errAlreadyPinned)
+		}
+		if !pin && !msg.Pinned {
+			return messageCommandErrorResponse(c, errNotPinned)
+		}
+
+		filter := bson.M{"_id": roomId, "messages._id": msgId}
+		var update bson.M
+		pinnedAt := primitive.NewDateTimeFromTime(time.Now())
+		if pin {
+			//the number of pinned messages is checked inside the update, so pinning two at once can't go over the limit
+			filter["$expr"] = bson.M{"$lt": bson.A{
+				bson.M{"$size": bson.M{"$filter": bson.M{
+					"input": "$messages",
+					"cond":  bson.M{"$eq": bson.A{"$$this.pinned", true}},
+				}}},
+				maxPinnedMessages(),
+			}}
+			update = bson.M{"$set": bson.M{
+				"messages.$.pinned":    true,
+				"messages.$.pinned_at": pinnedAt,
+				"messages.$.pinned_by": uid.Hex(),
+			}}
+		} else {
+			update = bson.M{"$unset": bson.M{
+				"messages.$.pinned":    "",
+				"messages.$.pinned_at": "",
+				"messages.$.pinned_by": "",
+			}}
+		}
+		res, err := db.RoomCollection.UpdateOne(c.Context(), filter, update)
+		if err != nil {
+			return messageCommandErrorResponse(c, err)
+		}
+		if res.MatchedCount == 0 {
+			//either the message was deleted in between finding it and updating it, or the room is at the limit
+			if !pin {
+				return messageCommandErrorResponse(c, errMessageNotFound)
+			}
+			count, err := db.RoomCollection.CountDocuments(c.Context(), bson.M{"_id": roomId, "messages._id": msgId})
+			if err != nil {
+				return messageCommandErrorResponse(c, err)
+			}
+			if count == 0 {
+				return messageCommandErrorResponse(c, errMessageNotFound)
+			}
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": fmt.Sprintf("A room can only have %d pinned messages", maxPinnedMessages()),
+			})
+		}
+
+		if pin {
+			sendToRoom(chatServer, roomId.Hex(), fiber.Map{
+				"event_type": "message_pin",
+				"ID":         msgId.Hex(),
+				"pinned_at":  pinnedAt,
+				"pinned_by":  uid.Hex(),
+			})
+		} else {
+			sendToRoom(chatServer, roomId.Hex(), fiber.Map{
+				"event_type": "message_unpin",
+				"ID":         msgId.Hex(),
+			})
+		}
+
+		c.Status(fiber.StatusOK)
+		if pin {
+			return c.JSON(fiber.Map{
+				"message": "Message pinned",
+			})
+		}
+		return c.JSON(fiber.Map{
+			"message": "Message unpinned",
+		})
+	}
+}
+
+// Get the pinned messages in a room, most recently pinned first, for users who can see the room
+func HandleGetPinnedMessages(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+
+		var room models.Room
+		if err := db.RoomCollection.FindOne(c.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+			if err == mongo.ErrNoDocuments {
+				return messageCommandErrorResponse(c, errRoomNotFound)
+			}
+			return messageCommandErrorResponse(c, err)
+		}
+		if !canViewRoom(chatServer, &room, c.Locals("uid").(primitive.ObjectID)) {
+			return messageCommandErrorResponse(c, errNotAllowed)
+		}
+
+		pinned := []models.Message{}
+		for _, m := range room.Messages {
+			if m.Pinned {
+				pinned = append(pinned, m)
+			}
+		}
+		sort.Slice(pinned, func(a, b int) bool {
+			return pinned[a].PinnedAt > pinned[b].PinnedAt
+		})
+		summarizeReactions(pinned, c.Locals("uid").(primitive.ObjectID))
+		signMessageAttachments(pinned, roomMembers(&room), c.Locals("uid").(primitive.ObjectID))
+
+		c.Status(fiber.StatusOK)
+		return c.JSON(pinned)
+	}
+}
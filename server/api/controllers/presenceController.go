@@ -0,0 +1,175 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const awayAfter = 5 * time.Minute //users with no socket activity for this long are marked as away
+
+const (
+	presenceOnline  = "online"
+	presenceAway    = "away"
+	presenceOffline = "offline"
+)
+
+// kind is "connect", "disconnect", "activity" or "away"
+type PresenceEvent struct {
+	uid  string
+	kind string
+}
+
+// used to get the presence of users from outside the presence goroutine. offline users aren't in the reply.
+type PresenceQuery struct {
+	uids  []string
+	reply chan map[string]string
+}
+
+type presenceState struct {
+	status     string
+	lastActive time.Time
+}
+
+func sendPresenceUpdate(chatServer *ChatServer, uid string, status string, lastSeen primitive.DateTime) {
+	data := fiber.Map{
+		"event_type": "presence_update",
+		"uid":        uid,
+		"presence":   status,
+	}
+	if lastSeen != 0 {
+		data["last_seen"] = lastSeen
+	}
+	for conn := range chatServer.connections {
+		conn.WriteJSON(data)
+	}
+}
+
+func sendRoomLeave(chatServer *ChatServer, roomId string, uid string) {
+	sendToRoomExcept(chatServer, roomId, uid, fiber.Map{
+		"event_type": "room_leave",
+		"uid":        uid,
+		"room_id":    roomId,
+	})
+}
+
+// get the presence of each user, users that aren't connected are offline
+func getPresence(chatServer *ChatServer, uids []string) map[string]string {
+	reply := make(chan map[string]string)
+	chatServer.presenceQueryChan <- PresenceQuery{uids: uids, reply: reply}
+	statuses := <-reply
+	for _, uid := range uids {
+		if _, ok := statuses[uid]; !ok {
+			statuses[uid] = presenceOffline
+		}
+	}
+	return statuses
+}
+
+// Keeps track of who is online or away. Runs in its own goroutine so the presence state is only touched here.
+// When a user disconnects their last seen time is saved on their account.
+func watchPresence(chatServer *ChatServer) {
+	users := make(map[string]*presenceState)
+	ticker := time.NewTicker(30 * time.Second)
+	for {
+		select {
+		case ev := <-chatServer.presenceChan:
+			state, ok := users[ev.uid]
+			switch ev.kind {
+			case "connect":
+				users[ev.uid] = &presenceState{status: presenceOnline, lastActive: time.Now()}
+				if !ok || state.status != presenceOnline {
+					sendPresenceUpdate(chatServer, ev.uid, presenceOnline, 0)
+				}
+			case "disconnect":
+				if !ok {
+					continue
+				}
+				delete(users, ev.uid)
+				lastSeen := primitive.NewDateTimeFromTime(time.Now())
+				if oid, err := primitive.ObjectIDFromHex(ev.uid); err == nil {
+					db.UserCollection.UpdateByID(context.TODO(), oid, bson.M{"$set": bson.M{"last_seen": lastSeen}})
+				}
+				sendPresenceUpdate(chatServer, ev.uid, presenceOffline, lastSeen)
+			case "activity":
+				if !ok {
+					continue
+				}
+				state.lastActive = time.Now()
+				if state.status != presenceOnline {
+					state.status = presenceOnline
+					sendPresenceUpdate(chatServer, ev.uid, presenceOnline, 0)
+				}
+			case "away":
+				if ok && state.status != presenceAway {
+					state.status = presenceAway
+					sendPresenceUpdate(chatServer, ev.uid, presenceAway, 0)
+				}
+			}
+		case q := <-chatServer.presenceQueryChan:
+			statuses := make(map[string]string)
+			for _, uid := range q.uids {
+				if state, ok := users[uid]; ok {
+					statuses[uid] = state.status
+				}
+			}
+			q.reply <- statuses
+		case <-ticker.C:
+			for uid, state := range users {
+				if state.status == presenceOnline && time.Since(state.lastActive) > awayAfter {
+					state.status = presenceAway
+					sendPresenceUpdate(chatServer, uid, presenceAway, 0)
+				}
+			}
+		}
+	}
+}
+
+// Get the users currently viewing a room and their presence
+func HandleGetRoomMembers(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+
+		if err := db.RoomCollection.FindOne(c.Context(), bson.M{"_id": roomId}).Err(); err != nil {
+			if err == mongo.ErrNoDocuments {
+				c.Status(fiber.StatusNotFound)
+				return c.JSON(fiber.Map{
+					"message": "Room not found",
+				})
+			}
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+
+		uids := []string{}
+		for uid := range roomViewers(chatServer, roomId.Hex()) {
+			uids = append(uids, uid.Hex())
+		}
+		statuses := getPresence(chatServer, uids)
+
+		members := []fiber.Map{}
+		for _, uid := range uids {
+			members = append(members, fiber.Map{
+				"uid":      uid,
+				"presence": statuses[uid],
+			})
+		}
+
+		c.Status(fiber.StatusOK)
+		return c.JSON(members)
+	}
+}
@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const maxReactionsPerMessage = 20 //max number of distinct emojis on a single message
+const maxEmojiBytes = 32          //long enough for zwj sequences like families and flags with skin tones
+
+var (
+	errInvalidEmoji     = errors.New("Invalid emoji")
+	errTooManyReactions = errors.New("This message has too many different reactions")
+)
+
+// checks the string is a single emoji (or emoji sequence). the first rune must be a symbol, the rest can be
+// modifiers, variation selectors, zero width joiners, keycaps and tags that make up emoji sequences. keycaps
+// like 1️⃣ are the exception, they start with a digit, # or *.
+func isEmoji(s string) bool {
+	if s == "" || len(s) > maxEmojiBytes || !utf8.ValidString(s) {
+		return false
+	}
+	if isKeycap(s) {
+		return true
+	}
+	for i, r := range s {
+		if i == 0 {
+			if !unicode.Is(unicode.So, r) {
+				return false
+			}
+			continue
+		}
+		switch {
+		case unicode.Is(unicode.So, r), unicode.Is(unicode.Sk, r), unicode.Is(unicode.Mn, r), unicode.Is(unicode.Me, r):
+		case r == '\u200d': //zero width joiner
+		case r >= 0xE0020 && r <= 0xE007F: //tag characters used by subdivision flags
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// a digit, # or * followed by the combining keycap, with or without a variation selector in between
+func isKeycap(s string) bool {
+	runes := []rune(s)
+	if len(runes) == 3 && runes[1] == '\uFE0F' {
+		runes = []rune{runes[0], runes[2]}
+	}
+	if len(runes) != 2 || runes[1] != '\u20E3' {
+		return false
+	}
+	return (runes[0] >= '0' && runes[0] <= '9') || runes[0] == '#' || runes[0] == '*'
+}
+
+// fill in ReactionCounts on every message from the stored user sets, sorted by count then emoji so the order is stable
+func summarizeReactions(messages []models.Message, uid primitive.ObjectID) {
+	for i := range messages {
+		counts := []models.ReactionCount{}
+		for emoji, uids := range messages[i].Reactions {
+			if len(uids) == 0 {
+				continue
+			}
+			reacted := false
+			for _, id := range uids {
+				if id == uid {
+					reacted = true
+					break
+				}
+			}
+			counts = append(counts, models.ReactionCount{
+				Emoji:   emoji,
+				Count:   len(uids),
+				Reacted: reacted,
+			})
+		}
+		sort.Slice(counts, func(a, b int) bool {
+			if counts[a].Count != counts[b].Count {
+				return counts[a].Count > counts[b].Count
+			}
+			return counts[a].Emoji < counts[b].Emoji
+		})
+		messages[i].ReactionCounts = counts
+	}
+}
+
+// add or remove the users reaction and send the new count for that emoji to everyone in the room
+func setReaction(ctx context.Context, chatServer *ChatServer, roomId primitive.ObjectID, msgId primitive.ObjectID, uid primitive.ObjectID, emoji string, add bool) error {
+	if !isEmoji(emoji) {
+		return errInvalidEmoji
+	}
+	if _, _, err := findRoomMessage(ctx, roomId, msgId); err != nil {
+		return err
+	}
+
+	field := "messages.$.reactions." + emoji
+	var err error
+	if add {
+		err = addReaction(ctx, roomId, msgId, uid, emoji)
+	} else {
+		_, err = db.RoomCollection.UpdateOne(ctx, bson.M{"_id": roomId, "messages._id": msgId}, bson.M{"$pull": bson.M{field: uid}})
+		if err == nil {
+			//remove the emoji entirely once nobody is reacting with it, so it doesn't count towards the limit
+			_, err = db.RoomCollection.UpdateOne(ctx, bson.M{
+				"_id": roomId,
+				"messages": bson.M{"$elemMatch": bson.M{
+					"_id":                msgId,
+					"reactions." + emoji: bson.M{"$size": 0},
+				}},
+			}, bson.M{"$unset": bson.M{field: ""}})
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	_, msg, err := findRoomMessage(ctx, roomId, msgId)
+	if err != nil {
+		return err
+	}
+	if add && !containsObjectID(msg.Reactions[emoji], uid) {
+		//the update left the message alone because it already had the most emojis it can have
+		return errTooManyReactions
+	}
+	eventType := "reaction_remove"
+	if add {
+		eventType = "reaction_add"
+	}
+	sendToRoom(chatServer, roomId.Hex(), fiber.Map{
+		"event_type": eventType,
+		"ID":         msgId.Hex(),
+		"emoji":      emoji,
+		"uid":        uid.Hex(),
+		"count":      len(msg.Reactions[emoji]),
+	})
+	return nil
+}
+
+// Add the users reaction. The limit on different emojis is checked in the same update, so reactions added at the
+// same time can't go over it. If the message already has too many the update leaves it as it was.
+func addReaction(ctx context.Context, roomId primitive.ObjectID, msgId primitive.ObjectID, uid primitive.ObjectID, emoji string) error {
+	reactions := bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$$message.reactions", bson.M{}}}}
+	sameEmoji := func(this string) bson.M {
+		return bson.M{"$eq": bson.A{this + ".k", emoji}}
+	}
+	_, err := db.RoomCollection.UpdateByID(ctx, roomId, bson.A{
+		bson.M{"$set": bson.M{"messages": bson.M{"$map": bson.M{
+			"input": "$messages",
+			"as":    "message",
+			"in": bson.M{"$let": bson.M{
+				"vars": bson.M{"reactions": reactions},
+				"in": bson.M{"$cond": bson.M{
+					"if": bson.M{"$and": bson.A{
+						bson.M{"$eq": bson.A{"$$message._id", msgId}},
+						bson.M{"$or": bson.A{
+							bson.M{"$in": bson.A{emoji, "$$reactions.k"}},
+							bson.M{"$lt": bson.A{bson.M{"$size": "$$reactions"}, maxReactionsPerMessage}},
+						}},
+					}},
+					"then": bson.M{"$mergeObjects": bson.A{"$$message", bson.M{"reactions": bson.M{"$arrayToObject": bson.M{"$concatArrays": bson.A{
+						bson.M{"$filter": bson.M{"input": "$$reactions", "cond": bson.M{"$not": bson.A{sameEmoji("$$this")}}}},
+						bson.A{bson.M{
+							"k": emoji,
+							"v": bson.M{"$setUnion": bson.A{
+								bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{
+									bson.M{"$map": bson.M{
+										"input": bson.M{"$filter": bson.M{"input": "$$reactions", "cond": sameEmoji("$$this")}},
+										"in":    "$$this.v",
+									}}, 0,
+								}}, bson.A{}}},
+								bson.A{uid},
+							}},
+						}},
+					}}}}}},
+					"else": "$$message",
+				}},
+			}},
+		}}}},
+	})
+	return err
+}
+
+func containsObjectID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// handle the reaction_add and reaction_remove websocket commands. the message must be in the room the connection is in.
+func handleReactionCommand(chatServer *ChatServer, c *websocket.Conn, ev models.MessageEvent) {
+	roomId, err := primitive.ObjectIDFromHex(roomIdForConn(chatServer, c))
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "You are not in a room",
+		})
+		return
+	}
+	msgId, err := primitive.ObjectIDFromHex(ev.ID)
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "Invalid message ID",
+		})
+		return
+	}
+	if err := setReaction(context.TODO(), chatServer, roomId, msgId, c.Locals("uid").(primitive.ObjectID), ev.Emoji, ev.EventType == "reaction_add"); err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    messageErrorText(err),
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package controllers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/api/validator"
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// handle the read_ack websocket command. the client sends the id of the newest message it has shown the user.
+func handleReadAck(chatServer *ChatServer, c *websocket.Conn, ev models.MessageEvent) {
+	roomIdHex := roomIdForConn(chatServer, c)
+	roomId, err := primitive.ObjectIDFromHex(roomIdHex)
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "You are not in a room",
+		})
+		return
+	}
+	msgId, err := primitive.ObjectIDFromHex(ev.ID)
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "Invalid message ID",
+		})
+		return
+	}
+	if _, _, err := findRoomMessage(context.TODO(), roomId, msgId); err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    messageErrorText(err),
+		})
+		return
+	}
+
+	uid := c.Locals("uid").(primitive.ObjectID)
+	//$max so an ack for an older message arriving late can't move the read position backwards
+	_, err = db.ReadStateCollection.UpdateOne(context.TODO(), bson.M{"uid": uid, "room_id": roomId}, bson.M{
+		"$max": bson.M{"last_read_id": msgId},
+		"$set": bson.M{"updated_at": primitive.NewDateTimeFromTime(time.Now())},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Println("Read state update error : ", err)
+		return
+	}
+	//mentions up to the acked message have been seen
+	db.NotificationCollection.UpdateMany(context.TODO(), bson.M{
+		"uid":        uid,
+		"room_id":    roomId,
+		"message_id": bson.M{"$lte": msgId},
+		"read":       false,
+	}, bson.M{"$set": bson.M{"read": true}})
+
+	var user models.User
+	if err := db.UserCollection.FindOne(context.TODO(), bson.M{"_id": uid}).Decode(&user); err != nil || !user.ShareReadReceipts {
+		return
+	}
+	for i := range chatServer.chatRooms {
+		if chatServer.chatRooms[i].roomId == roomIdHex {
+			for conn := range chatServer.chatRooms[i].connections {
+				if conn != c {
+					conn.WriteJSON(fiber.Map{
+						"event_type": "read_receipt",
+						"uid":        uid.Hex(),
+						"ID":         msgId.Hex(),
+					})
+				}
+			}
+		}
+	}
+}
+
+// fill in the unread and mention counts on rooms for the user requesting them. messages sent by the user
+// and thread replies don't count as unread.
+func countUnread(ctx context.Context, rooms []models.Room, uid primitive.ObjectID) error {
+	lastRead := make(map[primitive.ObjectID]primitive.ObjectID)
+	cursor, err := db.ReadStateCollection.Find(ctx, bson.M{"uid": uid})
+	if err != nil {
+		return err
+	}
+	for cursor.Next(ctx) {
+		var state models.ReadState
+		if err := cursor.Decode(&state); err != nil {
+			cursor.Close(ctx)
+			return err
+		}
+		lastRead[state.RoomID] = state.LastReadID
+	}
+	cursor.Close(ctx)
+
+	mentions := make(map[primitive.ObjectID]int)
+	cursor, err = db.NotificationCollection.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"uid": uid, "read": false}},
+		bson.M{"$group": bson.M{"_id": "$room_id", "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	for cursor.Next(ctx) {
+		var group struct {
+			RoomID primitive.ObjectID `bson:"_id"`
+			Count  int                `bson:"count"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			cursor.Close(ctx)
+			return err
+		}
+		mentions[group.RoomID] = group.Count
+	}
+	cursor.Close(ctx)
+
+	for i := range rooms {
+		unread := 0
+		readUpTo := lastRead[rooms[i].ID]
+		for _, m := range rooms[i].Messages {
+			if m.ParentID == nil && m.Uid != uid.Hex() && m.ID.Hex() > readUpTo.Hex() {
+				unread++
+			}
+		}
+		rooms[i].UnreadCount = unread
+		rooms[i].MentionCount = mentions[rooms[i].ID]
+	}
+	return nil
+}
+
+// Get how far each user sharing read receipts has read in the room, for users who can see the room
+func HandleGetReadReceipts(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+
+		//read positions are only shown to users who can see the room
+		var room models.Room
+		if err := db.RoomCollection.FindOne(c.Context(), bson.M{"_id": roomId}, options.FindOne().SetProjection(bson.M{
+			"author_id":    1,
+			"moderators":   1,
+			"messages.uid": 1,
+		})).Decode(&room); err != nil {
+			if err == mongo.ErrNoDocuments {
+				err = errRoomNotFound
+			}
+			return messageCommandErrorResponse(c, err)
+		}
+		if !canViewRoom(chatServer, &room, c.Locals("uid").(primitive.ObjectID)) {
+			return messageCommandErrorResponse(c, errNotAllowed)
+		}
+
+		cursor, err := db.ReadStateCollection.Find(c.Context(), bson.M{"room_id": roomId})
+		if err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+		states := []models.ReadState{}
+		if err := cursor.All(c.Context(), &states); err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+
+		uids := []primitive.ObjectID{}
+		for _, state := range states {
+			uids = append(uids, state.Uid)
+		}
+		sharing := make(map[primitive.ObjectID]bool)
+		cursor, err = db.UserCollection.Find(c.Context(), bson.M{"_id": bson.M{"$in": uids}, "share_read_receipts": true})
+		if err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+		for cursor.Next(c.Context()) {
+			var user models.User
+			if cursor.Decode(&user) == nil {
+				sharing[user.ID] = true
+			}
+		}
+		cursor.Close(c.Context())
+
+		receipts := []models.ReadState{}
+		for _, state := range states {
+			if sharing[state.Uid] {
+				receipts = append(receipts, state)
+			}
+		}
+
+		c.Status(fiber.StatusOK)
+		return c.JSON(receipts)
+	}
+}
+
+// Turn sharing read receipts on or off for the user
+func HandleSetReadReceipts(c *fiber.Ctx) error {
+	var body validator.ReadReceiptsSetting
+	if err := c.BodyParser(&body); err != nil {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Bad request",
+		})
+	}
+
+	if _, err := db.UserCollection.UpdateByID(c.Context(), c.Locals("uid").(primitive.ObjectID), bson.M{"$set": bson.M{"share_read_receipts": body.Enabled}}); err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+
+	c.Status(fiber.StatusOK)
+	return c.JSON(fiber.Map{
+		"message": "Updated read receipts setting",
+	})
+}
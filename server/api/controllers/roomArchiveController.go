@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/api/archive"
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+const maxRoomNameLength = 24
+const maxImportSize = 2 * 1024 * 1024 * 1024 //2gb, archives are streamed to a temporary file so they can be bigger than the body limit
+
+// Apply the same limits to an imported room as to one made through the API. The name and tags are normalised,
+// anything else that is out of bounds rejects the archive.
+func ValidateArchiveRoom(room *models.Room) error {
+	room.Name = strings.TrimSpace(room.Name)
+	if room.Name == "" || utf8.RuneCountInString(room.Name) > maxRoomNameLength {
+		return fmt.Errorf("Room name must be between 1 and %d characters", maxRoomNameLength)
+	}
+	tags, err := normalizeTags(room.Tags)
+	if err != nil {
+		return err
+	}
+	room.Tags = tags
+	for i := range room.Messages {
+		m := &room.Messages[i]
+		if len(m.Content) > 200 {
+			return errors.New("Message content too long, max 200 characters")
+		}
+		for _, edit := range m.Edits {
+			if len(edit.Content) > 200 {
+				return errors.New("Message content too long, max 200 characters")
+			}
+		}
+		if len(m.Reactions) > maxReactionsPerMessage {
+			return errTooManyReactions
+		}
+		for emoji, uids := range m.Reactions {
+			if !isEmoji(emoji) {
+				return errInvalidEmoji
+			}
+			//each user can only react with an emoji once
+			deduped := []primitive.ObjectID{}
+			for _, uid := range uids {
+				if !containsObjectID(deduped, uid) {
+					deduped = append(deduped, uid)
+				}
+			}
+			m.Reactions[emoji] = deduped
+		}
+	}
+	return nil
+}
+
+// Download a zip archive of the room, its messages, image and attachments. Only the owner of the room can do
+// this, the archive is written to the response as it is made.
+func HandleExportRoom(c *fiber.Ctx) error {
+	roomId, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Invalid ID",
+		})
+	}
+
+	var room models.Room
+	if err := db.RoomCollection.FindOne(c.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return messageCommandErrorResponse(c, errRoomNotFound)
+		}
+		return messageCommandErrorResponse(c, err)
+	}
+	if room.Author != c.Locals("uid").(primitive.ObjectID) {
+		return messageCommandErrorResponse(c, errNotAllowed)
+	}
+
+	c.Status(fiber.StatusOK)
+	c.Type("zip")
+	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"room-%v.zip\"", unsafeFilenameChars.ReplaceAllString(room.Name, "_")))
+	//the stream writer runs after the handler has returned, so it can't use the request context. the status has
+	//already been sent by the time anything goes wrong, so errors are only logged and the zip is left unfinished.
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := archive.Export(context.TODO(), roomId, w); err != nil {
+			log.Println("Room export error : ", err)
+		}
+		w.Flush()
+	})
+	return nil
+}
+
+// Create a new room owned by the user from an archive made by HandleExportRoom, uploaded as "file". Other users
+// in the archive become placeholders, see archive.ImportOptions.
+func HandleImportRoom(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		//checked before reading, the body is streamed so the app's body limit doesn't apply. -1 is chunked.
+		length := c.Request().Header.ContentLength()
+		if length == -1 {
+			c.Status(fiber.StatusLengthRequired)
+			return c.JSON(fiber.Map{
+				"message": "Content-Length required",
+			})
+		}
+		if int64(length) > maxImportSize {
+			c.Status(fiber.StatusRequestEntityTooLarge)
+			return c.JSON(fiber.Map{
+				"message": "Archive too large. Max 2gb.",
+			})
+		}
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "No archive uploaded",
+			})
+		}
+		src, err := file.Open()
+		if err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+		defer src.Close()
+
+		uid := c.Locals("uid").(primitive.ObjectID)
+		roomId, err := archive.Import(c.Context(), src, file.Size, uid, archive.ImportOptions{Validate: ValidateArchiveRoom})
+		if err != nil {
+			if errors.Is(err, archive.ErrInvalidArchive) {
+				c.Status(fiber.StatusBadRequest)
+				return c.JSON(fiber.Map{
+					"message": err.Error(),
+				})
+			}
+			log.Println("Room import error : ", err)
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+
+		var room models.Room
+		if err := db.RoomCollection.FindOne(c.Context(), bson.M{"_id": roomId}).Decode(&room); err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+
+		for conn := range chatServer.connections {
+			if conn.Locals("uid").(primitive.ObjectID) != uid {
+				conn.WriteJSON(fiber.Map{
+					"ID":         roomId.Hex(),
+					"name":       room.Name,
+					"author_id":  uid.Hex(),
+					"tags":       room.Tags,
+					"event_type": "chatroom_update",
+				})
+			}
+		}
+
+		c.Status(fiber.StatusCreated)
+		return c.JSON(fiber.Map{
+			"ID":         roomId.Hex(),
+			"name":       room.Name,
+			"created_at": room.CreatedAt,
+			"updated_at": room.UpdatedAt,
+			"author_id":  uid.Hex(),
+			"tags":       room.Tags,
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultSearchPageSize = 20
+const maxSearchPageSize = 50
+const maxSearchQueryLength = 100
+const snippetContext = 40 //characters either side of the first match in the snippet
+
+type SearchResult struct {
+	RoomID     primitive.ObjectID `json:"room_id"`
+	RoomName   string             `json:"room_name"`
+	Message    models.Message     `json:"message"`
+	Snippet    string             `json:"snippet"`
+	Highlights [][2]int           `json:"highlights"` // start and end character offsets of the matches in the snippet
+}
+
+// split a search query into the words to look for and the words to leave out ("-word"). quotes are ignored.
+func searchTerms(query string) (terms []string, negated []string) {
+	terms, negated = []string{}, []string{}
+	for _, word := range strings.Fields(strings.ReplaceAll(query, "\"", " ")) {
+		if strings.HasPrefix(word, "-") {
+			if len(word) > 1 {
+				negated = append(negated, word[1:])
+			}
+			continue
+		}
+		terms = append(terms, word)
+	}
+	return terms, negated
+}
+
+// a case insensitive pattern matching any of the words
+func searchPattern(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+	return strings.Join(quoted, "|")
+}
+
+// cut the content down to the part around the first match and find where each match is inside it
+func highlightSnippet(content string, termsRegex *regexp.Regexp) (string, [][2]int) {
+	highlights := [][2]int{}
+	first := termsRegex.FindStringIndex(content)
+	if first == nil {
+		return truncateContent(content), highlights
+	}
+
+	runes := []rune(content)
+	matchStart := utf8.RuneCountInString(content[:first[0]])
+	start := matchStart - snippetContext
+	if start < 0 {
+		start = 0
+	}
+	end := matchStart + snippetContext*2
+	if end > len(runes) {
+		end = len(runes)
+	}
+	snippet := string(runes[start:end])
+	prefix := ""
+	if start > 0 {
+		prefix = "…"
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	snippet = prefix + snippet
+
+	for _, match := range termsRegex.FindAllStringIndex(snippet, -1) {
+		highlights = append(highlights, [2]int{
+			utf8.RuneCountInString(snippet[:match[0]]),
+			utf8.RuneCountInString(snippet[:match[1]]),
+		})
+	}
+	return snippet, highlights
+}
+
+// Search message content in the rooms the user is a member of, using the text index on the message content. A
+// message matches if it contains any of the words and none of the negated ones. Filters are ?room=, ?author=, ?from= and ?to= (RFC3339 dates),
+// ?has_attachment=true/false. Results are newest first, pass next_cursor as ?cursor= for the next page.
+func HandleSearchMessages(c *fiber.Ctx) error {
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" || len(query) > maxSearchQueryLength {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Search query must be between 1 and 100 characters",
+		})
+	}
+	terms, negated := searchTerms(query)
+	if len(terms) == 0 {
+		c.Status(fiber.StatusBadRequest)
+		return c.JSON(fiber.Map{
+			"message": "Search query has no words to search for",
+		})
+	}
+	uid := c.Locals("uid").(primitive.ObjectID)
+	termsPattern := searchPattern(terms)
+	termsRegex := regexp.MustCompile("(?i)" + termsPattern)
+
+	limit := defaultSearchPageSize
+	if c.Query("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > maxSearchPageSize {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid limit",
+			})
+		}
+	}
+
+	//the text index narrows the rooms down to the users rooms with a message containing one of the words, then
+	//the messages are unwound and filtered individually. negated words can only be checked per message, a room
+	//with one message containing a negated word can still have others that match.
+	contentMatch := bson.M{"$regex": termsPattern, "$options": "i"}
+	roomMatch := bson.M{
+		"$text": bson.M{"$search": strings.Join(terms, " ")},
+		"$or": bson.A{
+			bson.M{"author_id": uid},
+			bson.M{"moderators": uid},
+			bson.M{"messages.uid": uid.Hex()},
+		},
+	}
+	msgMatch := bson.M{"messages.content": contentMatch}
+	if len(negated) > 0 {
+		msgMatch["$and"] = bson.A{
+			bson.M{"messages.content": bson.M{"$not": primitive.Regex{Pattern: searchPattern(negated), Options: "i"}}},
+		}
+	}
+	if c.Query("room") != "" {
+		roomId, err := primitive.ObjectIDFromHex(c.Query("room"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid room ID",
+			})
+		}
+		roomMatch["_id"] = roomId
+	}
+	if c.Query("author") != "" {
+		if _, err := primitive.ObjectIDFromHex(c.Query("author")); err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid author ID",
+			})
+		}
+		msgMatch["messages.uid"] = c.Query("author")
+	}
+	timestampMatch := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lte"} {
+		if c.Query(param) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, c.Query(param))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid " + param + " date, use RFC3339",
+			})
+		}
+		timestampMatch[op] = primitive.NewDateTimeFromTime(t)
+	}
+	if len(timestampMatch) > 0 {
+		msgMatch["messages.timestamp"] = timestampMatch
+	}
+	if c.Query("has_attachment") != "" {
+		msgMatch["messages.has_attachment"] = c.Query("has_attachment") == "true"
+	}
+	if c.Query("cursor") != "" {
+		cursorId, err := primitive.ObjectIDFromHex(c.Query("cursor"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid cursor",
+			})
+		}
+		msgMatch["messages._id"] = bson.M{"$lt": cursorId}
+	}
+
+	cursor, err := db.RoomCollection.Aggregate(c.Context(), bson.A{
+		bson.M{"$match": roomMatch},
+		//the ids roomMembers needs are kept from before the messages are unwound
+		bson.M{"$project": bson.M{"name": 1, "messages": 1, "author_id": 1, "moderators": 1, "message_uids": "$messages.uid"}},
+		bson.M{"$unwind": "$messages"},
+		bson.M{"$match": msgMatch},
+		bson.M{"$sort": bson.M{"messages._id": -1}},
+		//one extra to know if there is another page
+		bson.M{"$limit": limit + 1},
+	})
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	var unwound []struct {
+		ID          primitive.ObjectID   `bson:"_id"`
+		Name        string               `bson:"name"`
+		Messages    models.Message       `bson:"messages"`
+		Author      primitive.ObjectID   `bson:"author_id"`
+		Moderators  []primitive.ObjectID `bson:"moderators"`
+		MessageUids []string             `bson:"message_uids"`
+	}
+	if err := cursor.All(c.Context(), &unwound); err != nil {
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+
+	nextCursor := ""
+	if len(unwound) > limit {
+		unwound = unwound[:limit]
+		nextCursor = unwound[limit-1].Messages.ID.Hex()
+	}
+	results := []SearchResult{}
+	for _, u := range unwound {
+		msgs := []models.Message{u.Messages}
+		summarizeReactions(msgs, uid)
+		room := models.Room{Author: u.Author, Moderators: u.Moderators}
+		for _, messageUid := range u.MessageUids {
+			room.Messages = append(room.Messages, models.Message{Uid: messageUid})
+		}
+		signMessageAttachments(msgs, roomMembers(&room), uid)
+		snippet, highlights := highlightSnippet(u.Messages.Content, termsRegex)
+		results = append(results, SearchResult{
+			RoomID:     u.ID,
+			RoomName:   u.Name,
+			Message:    msgs[0],
+			Snippet:    snippet,
+			Highlights: highlights,
+		})
+	}
+
+	c.Status(fiber.StatusOK)
+	return c.JSON(fiber.Map{
+		"results":     results,
+		"next_cursor": nextCursor,
+	})
+}
@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const defaultThreadPageSize = 20
+const maxThreadPageSize = 50
+
+var errNestedThread = errors.New("You cannot start a thread from a reply")
+
+type ThreadConnectionRegistration struct {
+	conn     *websocket.Conn
+	roomId   string
+	parentId string
+}
+
+func removeFromThreads(room *ChatRoom, conn *websocket.Conn) {
+	for parentId, conns := range room.threadConnections {
+		delete(conns, conn)
+		if len(conns) == 0 {
+			delete(room.threadConnections, parentId)
+		}
+	}
+}
+
+// send an event to the users viewing a thread. they are all in the room, so anything sent to the room reaches them too.
+func sendToThread(chatServer *ChatServer, roomId string, parentId string, data interface{}) {
+	for i := range chatServer.chatRooms {
+		if chatServer.chatRooms[i].roomId == roomId {
+			for conn := range chatServer.chatRooms[i].threadConnections[parentId] {
+				conn.WriteJSON(data)
+			}
+		}
+	}
+}
+
+// send the reply count and time of the last reply of a thread to everyone in the room, for the summary under the parent
+func sendThreadUpdate(chatServer *ChatServer, roomId primitive.ObjectID, parentId primitive.ObjectID) {
+	if _, parent, err := findRoomMessage(context.TODO(), roomId, parentId); err == nil {
+		//null once the last reply has been deleted
+		var lastReplyAt interface{}
+		if parent.ReplyCount > 0 {
+			lastReplyAt = parent.LastReplyAt
+		}
+		sendToRoom(chatServer, roomId.Hex(), fiber.Map{
+			"event_type":    "thread_update",
+			"ID":            parentId.Hex(),
+			"reply_count":   parent.ReplyCount,
+			"last_reply_at": lastReplyAt,
+		})
+	}
+}
+
+// Count the replies left in a thread and find when the last one was sent, after one has been deleted. It's worked out
+// inside the update, so a reply sent at the same time isn't missed. The last reply time is null when there are none left.
+func updateThreadSummary(ctx context.Context, roomId primitive.ObjectID, parentId primitive.ObjectID) error {
+	_, err := db.RoomCollection.UpdateByID(ctx, roomId, bson.A{
+		bson.M{"$set": bson.M{"messages": bson.M{"$map": bson.M{
+			"input": "$messages",
+			"as":    "message",
+			"in": bson.M{"$cond": bson.M{
+				"if": bson.M{"$eq": bson.A{"$$message._id", parentId}},
+				"then": bson.M{"$let": bson.M{
+					"vars": bson.M{"replies": bson.M{"$filter": bson.M{
+						"input": "$messages",
+						"cond":  bson.M{"$eq": bson.A{"$$this.parent_id", parentId}},
+					}}},
+					"in": bson.M{"$mergeObjects": bson.A{"$$message", bson.M{
+						"reply_count":   bson.M{"$size": "$$replies"},
+						"last_reply_at": bson.M{"$max": "$$replies.timestamp"},
+					}}},
+				}},
+				"else": "$$message",
+			}},
+		}}}},
+	})
+	return err
+}
+
+// find the parent message of a thread. replies can't have replies of their own, threads are only one level deep.
+func findThreadParent(ctx context.Context, roomId primitive.ObjectID, parentId primitive.ObjectID) (*models.Room, *models.Message, error) {
+	room, parent, err := findRoomMessage(ctx, roomId, parentId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent.ParentID != nil {
+		return nil, nil, errNestedThread
+	}
+	return room, parent, nil
+}
+
+// handle the thread_join and thread_leave websocket commands. users viewing a thread get the replies as they are sent.
+func handleThreadCommand(chatServer *ChatServer, c *websocket.Conn, ev models.MessageEvent) {
+	roomIdHex := roomIdForConn(chatServer, c)
+	roomId, err := primitive.ObjectIDFromHex(roomIdHex)
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "You are not in a room",
+		})
+		return
+	}
+	if ev.EventType == "thread_leave" {
+		chatServer.unregisterThreadConn <- ThreadConnectionRegistration{conn: c, roomId: roomIdHex}
+		return
+	}
+	parentId, err := primitive.ObjectIDFromHex(ev.ID)
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "Invalid message ID",
+		})
+		return
+	}
+	if _, _, err := findThreadParent(context.TODO(), roomId, parentId); err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    messageErrorText(err),
+		})
+		return
+	}
+	chatServer.registerThreadConn <- ThreadConnectionRegistration{conn: c, roomId: roomIdHex, parentId: parentId.Hex()}
+}
+
+// save a reply, send it to the users viewing the thread, and send the new reply count to the whole room
+func handleThreadReply(chatServer *ChatServer, c *websocket.Conn, ev models.MessageEvent) {
+	sendErr := func(err error) {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    messageErrorText(err),
+		})
+	}
+	if err := validateMessageContent(ev.Content); err != nil {
+		sendErr(err)
+		return
+	}
+	roomIdHex := roomIdForConn(chatServer, c)
+	roomId, err := primitive.ObjectIDFromHex(roomIdHex)
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "You are not in a room",
+		})
+		return
+	}
+	parentId, err := primitive.ObjectIDFromHex(ev.ParentID)
+	if err != nil {
+		c.WriteJSON(fiber.Map{
+			"event_type": "chatroom_err",
+			"content":    "Invalid message ID",
+		})
+		return
+	}
+	if _, _, err := findThreadParent(context.TODO(), roomId, parentId); err != nil {
+		sendErr(err)
+		return
+	}
+
+	var replyTo *models.QuotedMessage
+	if ev.ReplyTo != "" {
+		if replyTo, err = quoteMessage(context.TODO(), roomIdHex, ev.ReplyTo); err != nil {
+			sendErr(err)
+			return
+		}
+	}
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	msg := models.Message{
+		ID:                primitive.NewObjectID(),
+		Content:           ev.Content,
+		Uid:               c.Locals("uid").(primitive.ObjectID).Hex(),
+		Timestamp:         now,
+		HasAttachment:     ev.HasAttachment,
+		AttachmentPending: ev.HasAttachment,
+		ParentID:          &parentId,
+		ReplyTo:           replyTo,
+	}
+	if _, err := db.RoomCollection.UpdateOne(context.TODO(), bson.M{"_id": roomId}, bson.M{"$push": bson.M{"messages": msg}}); err != nil {
+		sendErr(err)
+		return
+	}
+	db.RoomCollection.UpdateOne(context.TODO(), bson.M{"_id": roomId, "messages._id": parentId}, bson.M{
+		"$inc": bson.M{"messages.$.reply_count": 1},
+		"$set": bson.M{"messages.$.last_reply_at": now},
+	})
+
+	notifyMentions(chatServer, roomId, msg)
+
+	sendToThread(chatServer, roomIdHex, parentId.Hex(), fiber.Map{
+		"event_type":         "thread_message",
+		"ID":                 msg.ID.Hex(),
+		"parent_id":          parentId.Hex(),
+		"content":            msg.Content,
+		"uid":                msg.Uid,
+		"timestamp":          msg.Timestamp,
+		"has_attachment":     msg.HasAttachment,
+		"attachment_pending": msg.AttachmentPending,
+		"reply_to":           msg.ReplyTo,
+	})
+	if msg.HasAttachment {
+		c.WriteJSON(fiber.Map{
+			"event_type": "attachment_upload",
+			"ID":         msg.ID.Hex(),
+			"roomID":     roomIdHex,
+		})
+	}
+
+	sendThreadUpdate(chatServer, roomId, parentId)
+}
+
+// Get the replies in a thread, oldest first, for users who can see the room it's in. Pass the next_cursor from the
+// previous page as ?after= to get the next page.
+func HandleGetThread(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		roomId, parentId, err := parseRoomAndMessageIds(c)
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+
+		limit := defaultThreadPageSize
+		if c.Query("limit") != "" {
+			limit, err = strconv.Atoi(c.Query("limit"))
+			if err != nil || limit < 1 || limit > maxThreadPageSize {
+				c.Status(fiber.StatusBadRequest)
+				return c.JSON(fiber.Map{
+					"message": "Invalid limit",
+				})
+			}
+		}
+		after := primitive.NilObjectID
+		if c.Query("after") != "" {
+			after, err = primitive.ObjectIDFromHex(c.Query("after"))
+			if err != nil {
+				c.Status(fiber.StatusBadRequest)
+				return c.JSON(fiber.Map{
+					"message": "Invalid cursor",
+				})
+			}
+		}
+
+		room, parent, err := findThreadParent(c.Context(), roomId, parentId)
+		if err != nil {
+			return messageCommandErrorResponse(c, err)
+		}
+		if !canViewRoom(chatServer, room, c.Locals("uid").(primitive.ObjectID)) {
+			return messageCommandErrorResponse(c, errNotAllowed)
+		}
+
+		//messages are pushed in the order they are sent so they are already sorted oldest first
+		replies := []models.Message{}
+		nextCursor := ""
+		for _, m := range room.Messages {
+			if m.ParentID == nil || *m.ParentID != parentId {
+				continue
+			}
+			//object ids start with the timestamp, so comparing the hex gives the order they were created in
+			if !after.IsZero() && m.ID.Hex() <= after.Hex() {
+				continue
+			}
+			if len(replies) == limit {
+				nextCursor = replies[len(replies)-1].ID.Hex()
+				break
+			}
+			replies = append(replies, m)
+		}
+		summarizeReactions(replies, c.Locals("uid").(primitive.ObjectID))
+		members := roomMembers(room)
+		signMessageAttachments(replies, members, c.Locals("uid").(primitive.ObjectID))
+		parentAndReactions := []models.Message{*parent}
+		summarizeReactions(parentAndReactions, c.Locals("uid").(primitive.ObjectID))
+		signMessageAttachments(parentAndReactions, members, c.Locals("uid").(primitive.ObjectID))
+
+		c.Status(fiber.StatusOK)
+		return c.JSON(fiber.Map{
+			"parent":      parentAndReactions[0],
+			"replies":     replies,
+			"next_cursor": nextCursor,
+		})
+	}
+}
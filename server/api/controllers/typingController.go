@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const typingThrottle = 3 * time.Second //typing_start is only sent to the room once per this duration per user
+const typingExpiry = 6 * time.Second   //if the client doesn't send typing_start again or typing_stop within this duration it is stopped automatically
+
+type TypingEvent struct {
+	uid    string
+	roomId string
+	typing bool
+}
+
+type typingState struct {
+	expires  time.Time
+	lastSent time.Time
+}
+
+// send to everyone in the room except the user
+func sendToRoomExcept(chatServer *ChatServer, roomId string, uid string, data interface{}) {
+	for r := range chatServer.chatRooms {
+		if chatServer.chatRooms[r].roomId == roomId {
+			for connUid, conn := range chatServer.chatRooms[r].connectionsByUid {
+				if connUid != uid {
+					conn.WriteJSON(data)
+				}
+			}
+		}
+	}
+}
+
+// handle the typing_start and typing_stop websocket commands
+func handleTypingCommand(chatServer *ChatServer, c *websocket.Conn, ev models.MessageEvent) {
+	roomId := roomIdForConn(chatServer, c)
+	if roomId == "" {
+		return
+	}
+	chatServer.typingChan <- TypingEvent{
+		uid:    c.Locals("uid").(primitive.ObjectID).Hex(),
+		roomId: roomId,
+		typing: ev.EventType == "typing_start",
+	}
+}
+
+// Keeps track of who is typing in each room. Runs in its own goroutine so the typing state is only touched here.
+func watchTyping(chatServer *ChatServer) {
+	//room id -> uid -> state
+	typers := make(map[string]map[string]*typingState)
+	stop := func(roomId string, uid string) {
+		delete(typers[roomId], uid)
+		if len(typers[roomId]) == 0 {
+			delete(typers, roomId)
+		}
+		sendToRoomExcept(chatServer, roomId, uid, fiber.Map{
+			"event_type": "typing_stop",
+			"uid":        uid,
+		})
+	}
+	ticker := time.NewTicker(time.Second)
+	for {
+		select {
+		case t := <-chatServer.typingChan:
+			state, isTyping := typers[t.roomId][t.uid]
+			if !t.typing {
+				if isTyping {
+					stop(t.roomId, t.uid)
+				}
+				continue
+			}
+			now := time.Now()
+			if !isTyping {
+				state = &typingState{}
+				if typers[t.roomId] == nil {
+					typers[t.roomId] = make(map[string]*typingState)
+				}
+				typers[t.roomId][t.uid] = state
+			}
+			state.expires = now.Add(typingExpiry)
+			if now.Sub(state.lastSent) >= typingThrottle {
+				state.lastSent = now
+				sendToRoomExcept(chatServer, t.roomId, t.uid, fiber.Map{
+					"event_type": "typing_start",
+					"uid":        t.uid,
+				})
+			}
+		case <-ticker.C:
+			now := time.Now()
+			for roomId, users := range typers {
+				for uid, state := range users {
+					if now.After(state.expires) {
+						stop(roomId, uid)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,435 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Resumable attachment uploads, following the tus 1.0.0 protocol (https://tus.io) with the creation, checksum,
+expiration and termination extensions:
+	POST   /api/room/:roomId/:msgId/upload   start an upload, with Upload-Length and Upload-Metadata (filename)
+	HEAD   /api/upload/:id                   get the Upload-Offset to carry on from
+	PATCH  /api/upload/:id                   send the next chunk from Upload-Offset, with an optional
+	                                         Upload-Checksum ("sha256 <base64 digest>")
+	DELETE /api/upload/:id                   give up on the upload
+When the last chunk arrives the attachment is saved the same way as HandleUploadAttachment. The uploader gets an
+attachment_progress event over the websocket after every chunk.
+*/
+
+const tusVersion = "1.0.0"
+const maxUploadChunkSize = 8 * 1024 * 1024 //8mb, chunks are kept in MongoDB documents until the upload is finished
+const uploadExpiry = 24 * time.Hour        //uploads that haven't had a chunk for this long are abandoned
+
+// tus uses this status when the Upload-Checksum doesn't match the chunk
+const statusChecksumMismatch = 460
+
+const (
+	uploadUploading  = "uploading"
+	uploadProcessing = "processing"
+)
+
+func setUploadHeaders(c *fiber.Ctx, upload *models.Upload) {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.Time().UTC().Format(http.TimeFormat))
+	c.Set("Cache-Control", "no-store")
+}
+
+// parse tus Upload-Metadata, comma separated "key base64value" pairs
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
+
+// find an upload that belongs to the user
+func findUpload(ctx context.Context, id string, uid primitive.ObjectID) (*models.Upload, error) {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, mongo.ErrNoDocuments
+	}
+	var upload models.Upload
+	if err := db.UploadCollection.FindOne(ctx, bson.M{"_id": oid, "uid": uid}).Decode(&upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// remove an upload and its chunks
+func deleteUpload(ctx context.Context, uploadId primitive.ObjectID) error {
+	if _, err := db.UploadChunkCollection.DeleteMany(ctx, bson.M{"upload_id": uploadId}); err != nil {
+		return err
+	}
+	_, err := db.UploadCollection.DeleteOne(ctx, bson.M{"_id": uploadId})
+	return err
+}
+
+// write the chunks of the upload in order to a temporary file, the caller has to remove it
+func assembleUpload(ctx context.Context, upload *models.Upload) (*os.File, error) {
+	f, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		cursor, err := db.UploadChunkCollection.Find(ctx, bson.M{"upload_id": upload.ID}, options.Find().SetSort(bson.D{{Key: "offset", Value: 1}}))
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+		var offset int64
+		for cursor.Next(ctx) {
+			var chunk models.UploadChunk
+			if err := cursor.Decode(&chunk); err != nil {
+				return err
+			}
+			if chunk.Offset != offset {
+				return fmt.Errorf("upload %v is missing the chunk at %d", upload.ID.Hex(), offset)
+			}
+			if _, err := f.Write(chunk.Data.Data); err != nil {
+				return err
+			}
+			offset += int64(len(chunk.Data.Data))
+		}
+		if err := cursor.Err(); err != nil {
+			return err
+		}
+		if offset != upload.Length {
+			return fmt.Errorf("upload %v has %d bytes of %d", upload.ID.Hex(), offset, upload.Length)
+		}
+		_, err = f.Seek(0, 0)
+		return err
+	}()
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// save the finished upload as one of the messages attachments
+func finishUpload(ctx context.Context, chatServer *ChatServer, upload *models.Upload) error {
+	//only one request gets to finish the upload
+	res, err := db.UploadCollection.UpdateOne(ctx, bson.M{"_id": upload.ID, "status": uploadUploading}, bson.M{"$set": bson.M{"status": uploadProcessing}})
+	if err != nil || res.ModifiedCount == 0 {
+		return err
+	}
+	f, err := assembleUpload(ctx, upload)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := saveAttachment(ctx, chatServer, upload.RoomId, upload.MsgId, upload.AttachmentId, upload.Filename, f, upload.Length); err != nil {
+		return err
+	}
+	return deleteUpload(ctx, upload.ID)
+}
+
+// Give up on uploads that haven't had a chunk for uploadExpiry, their attachments are marked as failed
+func ExpireUploads(ctx context.Context, chatServer *ChatServer) error {
+	cursor, err := db.UploadCollection.Find(ctx, bson.M{"expires_at": bson.M{"$lt": primitive.NewDateTimeFromTime(time.Now())}})
+	if err != nil {
+		return err
+	}
+	var uploads []models.Upload
+	if err := cursor.All(ctx, &uploads); err != nil {
+		return err
+	}
+	for _, upload := range uploads {
+		if err := deleteUpload(ctx, upload.ID); err != nil {
+			return err
+		}
+		markAttachmentError(ctx, chatServer, upload.RoomId, upload.MsgId, upload.AttachmentId)
+		log.Println("Upload expired : ", upload.ID.Hex())
+	}
+	return nil
+}
+
+// Start a resumable upload of another attachment for a message that was sent with has_attachment
+func HandleCreateUpload(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Resumable", tusVersion)
+		uid := c.Locals("uid").(primitive.ObjectID)
+
+		roomId, err := primitive.ObjectIDFromHex(c.Params("roomId"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid room ID",
+			})
+		}
+		msgId, err := primitive.ObjectIDFromHex(c.Params("msgId"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid message ID",
+			})
+		}
+		length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid Upload-Length",
+			})
+		}
+		if length > maxAttachmentSize {
+			c.Status(fiber.StatusRequestEntityTooLarge)
+			return c.JSON(fiber.Map{
+				"message": "File too large. Max 500mb.",
+			})
+		}
+
+		if err := checkCanAddAttachment(c.Context(), roomId, msgId, uid); err != nil {
+			return messageCommandErrorResponse(c, err)
+		}
+		filename := parseUploadMetadata(c.Get("Upload-Metadata"))["filename"]
+		attachment, err := addMessageAttachment(c.Context(), chatServer, roomId, msgId, filename, length)
+		if err != nil {
+			return messageCommandErrorResponse(c, err)
+		}
+
+		upload := models.Upload{
+			ID:           primitive.NewObjectID(),
+			Uid:          uid,
+			RoomId:       roomId,
+			MsgId:        msgId,
+			AttachmentId: attachment.ID,
+			Filename:     filename,
+			Length:       length,
+			Status:       uploadUploading,
+			CreatedAt:    primitive.NewDateTimeFromTime(time.Now()),
+			ExpiresAt:    primitive.NewDateTimeFromTime(time.Now().Add(uploadExpiry)),
+		}
+		if _, err := db.UploadCollection.InsertOne(c.Context(), upload); err != nil {
+			return attachmentError(c, msgId, roomId, attachment.ID, chatServer)
+		}
+
+		setUploadHeaders(c, &upload)
+		c.Set("Location", "/api/upload/"+upload.ID.Hex())
+		c.Status(fiber.StatusCreated)
+		return c.JSON(upload)
+	}
+}
+
+// Get how much of the upload has been received, to resume from
+func HandleGetUploadOffset(c *fiber.Ctx) error {
+	upload, err := findUpload(c.Context(), c.Params("id"), c.Locals("uid").(primitive.ObjectID))
+	if err != nil {
+		c.Set("Tus-Resumable", tusVersion)
+		if err == mongo.ErrNoDocuments {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	setUploadHeaders(c, upload)
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// Receive the next chunk of an upload. The last chunk saves the attachment.
+func HandleUploadChunk(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Resumable", tusVersion)
+		uid := c.Locals("uid").(primitive.ObjectID)
+
+		if c.Get("Content-Type") != "application/offset+octet-stream" {
+			c.Status(fiber.StatusUnsupportedMediaType)
+			return c.JSON(fiber.Map{
+				"message": "Content-Type must be application/offset+octet-stream",
+			})
+		}
+		offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid Upload-Offset",
+			})
+		}
+		//checked before reading so an oversized chunk is never held in memory
+		if c.Request().Header.ContentLength() > maxUploadChunkSize {
+			c.Status(fiber.StatusRequestEntityTooLarge)
+			return c.JSON(fiber.Map{
+				"message": "Chunk too large. Max 8mb.",
+			})
+		}
+		chunk := c.Body()
+		if len(chunk) > maxUploadChunkSize {
+			c.Status(fiber.StatusRequestEntityTooLarge)
+			return c.JSON(fiber.Map{
+				"message": "Chunk too large. Max 8mb.",
+			})
+		}
+
+		upload, err := findUpload(c.Context(), c.Params("id"), uid)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				c.Status(fiber.StatusNotFound)
+				return c.JSON(fiber.Map{
+					"message": "Upload not found",
+				})
+			}
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+		if upload.Status != uploadUploading || offset != upload.Offset {
+			setUploadHeaders(c, upload)
+			c.Status(fiber.StatusConflict)
+			return c.JSON(fiber.Map{
+				"message": "Upload-Offset does not match the upload",
+			})
+		}
+		if offset+int64(len(chunk)) > upload.Length {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Chunk goes past the end of the upload",
+			})
+		}
+
+		if header := c.Get("Upload-Checksum"); header != "" {
+			algorithm, value, _ := strings.Cut(header, " ")
+			if algorithm != "sha256" {
+				c.Status(fiber.StatusBadRequest)
+				return c.JSON(fiber.Map{
+					"message": "Unsupported checksum algorithm, use sha256",
+				})
+			}
+			expected, err := base64.StdEncoding.DecodeString(value)
+			sum := sha256.Sum256(chunk)
+			if err != nil || string(expected) != string(sum[:]) {
+				c.Status(statusChecksumMismatch)
+				return c.JSON(fiber.Map{
+					"message": "Checksum mismatch",
+				})
+			}
+		}
+
+		//the unique index on the offset stops two requests saving the same chunk, and the offset only moves if
+		//nothing else moved it first
+		chunkId := primitive.NewObjectID()
+		if _, err := db.UploadChunkCollection.InsertOne(c.Context(), models.UploadChunk{
+			ID:       chunkId,
+			UploadID: upload.ID,
+			Offset:   offset,
+			Data:     primitive.Binary{Data: chunk},
+		}); err != nil {
+			if mongo.IsDuplicateKeyError(err) {
+				c.Status(fiber.StatusConflict)
+				return c.JSON(fiber.Map{
+					"message": "Upload-Offset does not match the upload",
+				})
+			}
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+		upload.Offset += int64(len(chunk))
+		upload.ExpiresAt = primitive.NewDateTimeFromTime(time.Now().Add(uploadExpiry))
+		res, err := db.UploadCollection.UpdateOne(c.Context(), bson.M{"_id": upload.ID, "offset": offset, "status": uploadUploading}, bson.M{
+			"$set": bson.M{"offset": upload.Offset, "expires_at": upload.ExpiresAt},
+		})
+		if err != nil || res.ModifiedCount == 0 {
+			db.UploadChunkCollection.DeleteOne(c.Context(), bson.M{"_id": chunkId})
+			if err != nil {
+				c.Status(fiber.StatusInternalServerError)
+				return c.JSON(fiber.Map{
+					"message": "Internal error",
+				})
+			}
+			c.Status(fiber.StatusConflict)
+			return c.JSON(fiber.Map{
+				"message": "Upload-Offset does not match the upload",
+			})
+		}
+
+		if conn, ok := chatServer.connectionsByUid[uid.Hex()]; ok {
+			conn.WriteJSON(fiber.Map{
+				"event_type":    "attachment_progress",
+				"ID":            upload.MsgId.Hex(),
+				"attachment_id": upload.AttachmentId.Hex(),
+				"offset":        upload.Offset,
+				"length":        upload.Length,
+			})
+		}
+
+		if upload.Offset == upload.Length {
+			if err := finishUpload(c.Context(), chatServer, upload); err != nil {
+				log.Println("Upload error : ", err)
+				deleteUpload(c.Context(), upload.ID)
+				if isImageError(err) {
+					markAttachmentError(c.Context(), chatServer, upload.RoomId, upload.MsgId, upload.AttachmentId)
+					return imageErrorResponse(c, err)
+				}
+				return attachmentError(c, upload.MsgId, upload.RoomId, upload.AttachmentId, chatServer)
+			}
+		}
+
+		setUploadHeaders(c, upload)
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
+
+// Give up on an upload, its attachment is marked as failed
+func HandleCancelUpload(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Tus-Resumable", tusVersion)
+		upload, err := findUpload(c.Context(), c.Params("id"), c.Locals("uid").(primitive.ObjectID))
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				c.Status(fiber.StatusNotFound)
+				return c.JSON(fiber.Map{
+					"message": "Upload not found",
+				})
+			}
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+		if upload.Status != uploadUploading {
+			c.Status(fiber.StatusConflict)
+			return c.JSON(fiber.Map{
+				"message": "The upload is already being saved",
+			})
+		}
+		if err := deleteUpload(c.Context(), upload.ID); err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+		markAttachmentError(c.Context(), chatServer, upload.RoomId, upload.MsgId, upload.AttachmentId)
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+}
@@ -1,26 +1,24 @@
 package controllers
 
 import (
-	"bytes"
-	"encoding/base64"
+	"context"
 	"fmt"
-	"image"
-	"image/jpeg"
-	"image/png"
-	"strings"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/web-stuff-98/golang-chat-learning-project/api/helpers"
+	"github.com/web-stuff-98/golang-chat-learning-project/api/imaging"
 	"github.com/web-stuff-98/golang-chat-learning-project/api/validator"
 	"github.com/web-stuff-98/golang-chat-learning-project/db"
 	"github.com/web-stuff-98/golang-chat-learning-project/models"
-
-	"github.com/nfnt/resize"
+	"github.com/web-stuff-98/golang-chat-learning-project/storage"
 
 	"github.com/gofiber/fiber/v2"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -130,11 +128,11 @@ func HandleLogin(production bool) fiber.Handler {
 			})
 		}
 
-		var pfp models.Pfp
-		pfperr := db.PfpCollection.FindOne(c.Context(), bson.M{"_id": user.ID}).Decode(&pfp)
-
-		if pfperr == nil {
-			user.Base64pfp = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(pfp.Binary.Data)
+		if user.PfpURL, err = pfpURL(c.Context(), user.ID, user.PfpVersion); err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
 		}
 
 		if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(body.Password)); err != nil {
@@ -200,7 +198,8 @@ func HandleDeleteUser(protectedUids *map[primitive.ObjectID]struct{}) func(*fibe
 			})
 		}
 
-		_, err := db.UserCollection.DeleteOne(c.Context(), bson.M{"_id": c.Locals("uid").(primitive.ObjectID)})
+		//the account is deleted when the grace period ends, the user can log back in and cancel before then
+		job, err := scheduleAccountDeletion(c.Context(), c.Locals("uid").(primitive.ObjectID), accountDeletionGracePeriod())
 		if err != nil {
 			c.Status(fiber.StatusInternalServerError)
 			return c.JSON(fiber.Map{
@@ -209,9 +208,10 @@ func HandleDeleteUser(protectedUids *map[primitive.ObjectID]struct{}) func(*fibe
 		}
 
 		c.ClearCookie("session_token")
-		c.Status(fiber.StatusOK)
+		c.Status(fiber.StatusAccepted)
 		return c.JSON(fiber.Map{
-			"message": "Deleted account",
+			"message": "Account scheduled for deletion",
+			"run_at":  job.RunAt,
 		})
 	}
 }
@@ -332,12 +332,13 @@ func HandleRefresh(removeChatServerConnByUID chan string, production bool) fiber
 			})
 		}
 
-		var pfp models.Pfp
-		pfperr := db.PfpCollection.FindOne(c.Context(), bson.M{"_id": user["_id"]}).Decode(&pfp)
-		var base64pfp string
-
-		if pfperr == nil {
-			base64pfp = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(pfp.Binary.Data)
+		pfpVersion, _ := user["pfp_version"].(int64)
+		pfp, err := pfpURL(c.Context(), user["_id"].(primitive.ObjectID), pfpVersion)
+		if err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
 		}
 
 		c.Cookie(&fiber.Cookie{
@@ -350,11 +351,17 @@ func HandleRefresh(removeChatServerConnByUID chan string, production bool) fiber
 
 		c.Locals("uid", user["_id"].(primitive.ObjectID))
 
-		return c.JSON(fiber.Map{
-			"ID":        user["_id"],
-			"username":  user["username"],
-			"base64pfp": base64pfp,
-		})
+		res := fiber.Map{
+			"ID":       user["_id"],
+			"username": user["username"],
+		}
+		if pfp != "" {
+			res["pfp_url"] = pfp
+		}
+		if blurHash, ok := user["pfp_blurhash"]; ok {
+			res["pfp_blurhash"] = blurHash
+		}
+		return c.JSON(res)
 	}
 }
 
@@ -387,13 +394,6 @@ func HandleUpdatePfp(chatServer *ChatServer, protectedUids *map[primitive.Object
 			})
 		}
 
-		if !strings.HasPrefix(file.Header.Get("Content-Type"), "image/") {
-			c.Status(fiber.StatusBadRequest)
-			return c.JSON(fiber.Map{
-				"message": "File is not an image",
-			})
-		}
-
 		src, err := file.Open()
 		if err != nil {
 			c.Status(fiber.StatusInternalServerError)
@@ -403,70 +403,107 @@ func HandleUpdatePfp(chatServer *ChatServer, protectedUids *map[primitive.Object
 		}
 		defer src.Close()
 
-		var img image.Image
-		var decodeErr error
-		if file.Header.Get("Content-Type") == "image/jpeg" {
-			img, decodeErr = jpeg.Decode(src)
-		} else if file.Header.Get("Content-Type") == "image/png" {
-			img, decodeErr = png.Decode(src)
-		} else {
-			c.Status(fiber.StatusBadRequest)
-			return c.JSON(fiber.Map{
-				"message": "Unrecognized / unsupported format",
-			})
+		img, err := imaging.Process(src, 38)
+		if err != nil {
+			return imageErrorResponse(c, err)
 		}
-		if decodeErr != nil {
+
+		if err := storage.Pfps.Save(c.Context(), c.Locals("uid").(primitive.ObjectID), img.Data); err != nil {
 			c.Status(fiber.StatusInternalServerError)
 			return c.JSON(fiber.Map{
 				"message": "Internal error",
 			})
 		}
-
-		img = resize.Resize(38, 0, img, resize.Lanczos2)
-		buf := &bytes.Buffer{}
-		if err := jpeg.Encode(buf, img, nil); err != nil {
+		//a new version gives the pfp a new URL, so browsers don't show the old one they have cached
+		version := time.Now().UnixMilli()
+		if _, err := db.UserCollection.UpdateByID(c.Context(), c.Locals("uid").(primitive.ObjectID), bson.M{"$set": bson.M{
+			"pfp_blurhash": img.BlurHash,
+			"pfp_version":  version,
+		}}); err != nil {
 			c.Status(fiber.StatusInternalServerError)
 			return c.JSON(fiber.Map{
 				"message": "Internal error",
 			})
 		}
-
-		count, err := db.PfpCollection.CountDocuments(c.Context(), bson.M{"_id": c.Locals("uid").(primitive.ObjectID)})
-		if count != 0 {
-			db.PfpCollection.UpdateByID(c.Context(), c.Locals("uid").(primitive.ObjectID), models.Pfp{
-				Binary: primitive.Binary{Data: buf.Bytes()},
-			})
-		} else {
-			db.PfpCollection.InsertOne(c.Context(), models.Pfp{
-				ID:     c.Locals("uid").(primitive.ObjectID),
-				Binary: primitive.Binary{Data: buf.Bytes()},
-			})
-		}
+		url, _ := pfpURL(c.Context(), c.Locals("uid").(primitive.ObjectID), version)
 
 		//find all the chatrooms the user is in and send the pfp update to other users through the websocket api
 		for i := range chatServer.chatRooms {
 			for conn := range chatServer.chatRooms[i].connections {
 				if conn.Locals("uid").(primitive.ObjectID) != c.Locals("uid").(primitive.ObjectID) {
 					conn.WriteJSON(fiber.Map{
-						"ID":         c.Locals("uid").(primitive.ObjectID).Hex(),
-						"base64pfp":  "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
-						"event_type": "pfp_update",
+						"ID":           c.Locals("uid").(primitive.ObjectID).Hex(),
+						"pfp_url":      url,
+						"pfp_blurhash": img.BlurHash,
+						"event_type":   "pfp_update",
 					})
 				}
 			}
 		}
 
-		//clear the buffer. garbage collection does this automatically but this might be a little faster
-		buf = nil
-
 		c.Status(fiber.StatusOK)
 		return c.JSON(fiber.Map{
 			"message": "Updated pfp",
+			"pfp_url": url,
 		})
 	}
 }
 
-func HandleGetUser(c *fiber.Ctx) error {
+func HandleGetUser(chatServer *ChatServer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		uid, err := primitive.ObjectIDFromHex(c.Params("id"))
+		if err != nil {
+			c.Status(fiber.StatusBadRequest)
+			return c.JSON(fiber.Map{
+				"message": "Invalid ID",
+			})
+		}
+
+		var user models.User
+		count, err := db.UserCollection.CountDocuments(c.Context(), bson.M{"_id": uid})
+		if err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		} else if count == 0 {
+			c.Status(fiber.StatusNotFound)
+			return c.JSON(fiber.Map{
+				"message": "User not found",
+			})
+		}
+		db.UserCollection.FindOne(c.Context(), bson.M{"_id": uid}).Decode(&user)
+
+		if user.PfpURL, err = pfpURL(c.Context(), uid, user.PfpVersion); err != nil {
+			c.Status(fiber.StatusInternalServerError)
+			return c.JSON(fiber.Map{
+				"message": "Internal error",
+			})
+		}
+
+		user.Presence = getPresence(chatServer, []string{uid.Hex()})[uid.Hex()]
+
+		c.Status(fiber.StatusOK)
+		return c.JSON(user)
+	}
+}
+
+// The URL of the users pfp, or "" if they don't have one. The version in it changes whenever the pfp does, so
+// the browser can keep the image for as long as the URL stays the same.
+func pfpURL(ctx context.Context, uid primitive.ObjectID, version int64) (string, error) {
+	if version == 0 {
+		//pfps from before they had versions
+		exists, err := storage.Pfps.Exists(ctx, uid)
+		if err != nil || !exists {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("/api/user/%v/pfp?v=%d", uid.Hex(), version), nil
+}
+
+// Serve the users pfp. Requests for the current version (?v= from the pfp_url) can be cached for good, anything
+// else has to be checked with the ETag each time.
+func HandleGetPfp(c *fiber.Ctx) error {
 	uid, err := primitive.ObjectIDFromHex(c.Params("id"))
 	if err != nil {
 		c.Status(fiber.StatusBadRequest)
@@ -476,32 +513,61 @@ func HandleGetUser(c *fiber.Ctx) error {
 	}
 
 	var user models.User
-	count, err := db.UserCollection.CountDocuments(c.Context(), bson.M{"_id": uid})
+	if err := db.UserCollection.FindOne(c.Context(), bson.M{"_id": uid}, options.FindOne().SetProjection(bson.M{"pfp_version": 1})).Decode(&user); err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(fiber.StatusNotFound)
+			return c.JSON(fiber.Map{
+				"message": "User not found",
+			})
+		}
+		c.Status(fiber.StatusInternalServerError)
+		return c.JSON(fiber.Map{
+			"message": "Internal error",
+		})
+	}
+	exists, err := storage.Pfps.Exists(c.Context(), uid)
 	if err != nil {
 		c.Status(fiber.StatusInternalServerError)
 		return c.JSON(fiber.Map{
 			"message": "Internal error",
 		})
-	} else if count == 0 {
+	}
+	if !exists {
 		c.Status(fiber.StatusNotFound)
 		return c.JSON(fiber.Map{
-			"message": "User not found",
+			"message": "User has no pfp",
 		})
 	}
-	db.UserCollection.FindOne(c.Context(), bson.M{"_id": uid}).Decode(&user)
 
-	var pfp models.Pfp
-	pfpcount, pfperr := db.PfpCollection.CountDocuments(c.Context(), bson.M{"_id": uid})
-	if pfperr != nil {
+	//the version changes every time the pfp does, so the pfp only has to be loaded if the client doesn't have it
+	c.Set("ETag", fmt.Sprintf(`"%v-%d"`, uid.Hex(), user.PfpVersion))
+	if user.PfpVersion != 0 {
+		c.Set("Last-Modified", time.UnixMilli(user.PfpVersion).UTC().Format(http.TimeFormat))
+	}
+	if c.Query("v") == strconv.FormatInt(user.PfpVersion, 10) {
+		c.Set("Cache-Control", "private, max-age=31536000, immutable")
+	} else {
+		c.Set("Cache-Control", "private, no-cache")
+	}
+	if c.Fresh() {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	pfp, err := storage.Pfps.Get(c.Context(), uid)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			c.Status(fiber.StatusNotFound)
+			return c.JSON(fiber.Map{
+				"message": "User has no pfp",
+			})
+		}
 		c.Status(fiber.StatusInternalServerError)
 		return c.JSON(fiber.Map{
 			"message": "Internal error",
 		})
-	} else if pfpcount != 0 {
-		db.PfpCollection.FindOne(c.Context(), bson.M{"_id": uid}).Decode(&pfp)
-		user.Base64pfp = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(pfp.Binary.Data)
 	}
 
 	c.Status(fiber.StatusOK)
-	return c.JSON(user)
+	c.Set("Content-Type", imaging.MimeType(pfp))
+	return c.Send(pfp)
 }
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/web-stuff-98/golang-chat-learning-project/db"
@@ -33,6 +34,32 @@ func AuthMiddleware(c *fiber.Ctx) error {
 	return c.Next()
 }
 
+// With StreamRequestBody turned on, bodies bigger than the apps BodyLimit are streamed instead of being rejected.
+// This rejects them anywhere except the paths matching allowed, which read their bodies as a stream. Chunked
+// bodies have no length to check up front, so they are only accepted on the allowed paths as well.
+func LargeBodyMiddleware(limit int, allowed *regexp.Regexp) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if allowed.MatchString(c.Path()) {
+			return c.Next()
+		}
+		//-1 is chunked, requests without a Content-Length header at all have no body
+		length := c.Request().Header.ContentLength()
+		if length == -1 {
+			c.Status(fiber.StatusLengthRequired)
+			return c.JSON(fiber.Map{
+				"message": "Content-Length required",
+			})
+		}
+		if length > limit {
+			c.Status(fiber.StatusRequestEntityTooLarge)
+			return c.JSON(fiber.Map{
+				"message": "Request body too large",
+			})
+		}
+		return c.Next()
+	}
+}
+
 func WithUser(c *fiber.Ctx) error {
 	cookie := c.Cookies("session_token", "")
 	if cookie != "" {
@@ -0,0 +1,181 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+var errBadGIF = errors.New("gif: malformed block structure")
+
+// Count the frames of a GIF by skipping through its blocks, without decompressing anything
+func countGIFFrames(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, err
+	}
+	//the global color table follows the logical screen descriptor
+	if header[10]&0x80 != 0 {
+		if _, err := br.Discard(3 << ((header[10] & 0x07) + 1)); err != nil {
+			return 0, err
+		}
+	}
+	frames := 0
+	for {
+		introducer, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch introducer {
+		case 0x21: //extension, a label then data sub-blocks
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return 0, err
+			}
+		case 0x2c: //image descriptor, then the local color table, the LZW code size and the image data sub-blocks
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return 0, err
+			}
+			if descriptor[8]&0x80 != 0 {
+				if _, err := br.Discard(3 << ((descriptor[8] & 0x07) + 1)); err != nil {
+					return 0, err
+				}
+			}
+			if _, err := br.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(br); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3b: //trailer
+			return frames, nil
+		default:
+			return 0, errBadGIF
+		}
+	}
+}
+
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// Shrink every frame of an animated GIF and encode it again. Frames can be smaller than the image and rely on
+// what the frames before them left behind, so each one is drawn onto the whole image first the way a browser
+// would show it. The frames saved are all whole images that replace the last one. Parts of the image left by
+// earlier frames can have colors that aren't in the frames own palette, so each frame is saved with its palette
+// merged with the global one and the ones of the frames before it.
+func processAnimation(g *gif.GIF, maxWidth uint) (*Image, error) {
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewRGBA(screen)
+	out := &gif.GIF{LoopCount: g.LoopCount, Config: g.Config}
+	global, _ := g.Config.ColorModel.(color.Palette)
+	//most recent first, their colors are the most likely to still be showing
+	earlier := []color.Palette{}
+	for i, frame := range g.Image {
+		//the area is put back how it was before the frame if the frame asks for that
+		var previous *image.RGBA
+		disposal := byte(gif.DisposalNone)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(screen)
+			draw.Draw(previous, screen, canvas, image.Point{}, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		shrunk := shrink(canvas, maxWidth)
+		palettes := append([]color.Palette{frame.Palette, global}, earlier...)
+		paletted := image.NewPaletted(shrunk.Bounds(), mergePalettes(!isOpaque(shrunk), palettes...))
+		draw.Draw(paletted, paletted.Bounds(), shrunk, shrunk.Bounds().Min, draw.Src)
+		earlier = append([]color.Palette{frame.Palette}, earlier...)
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, g.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalNone)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	if len(out.Image) == 0 {
+		return nil, ErrInvalidImage
+	}
+	out.Config.Width = out.Image[0].Bounds().Dx()
+	out.Config.Height = out.Image[0].Bounds().Dy()
+	//the frames have their own palettes
+	out.Config.ColorModel = nil
+
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, out); err != nil {
+		return nil, fmt.Errorf("encoding gif: %w", err)
+	}
+	return &Image{
+		Data:     buf.Bytes(),
+		MimeType: "image/gif",
+		Width:    out.Config.Width,
+		Height:   out.Config.Height,
+		Frames:   len(out.Image),
+		Preview:  out.Image[0],
+		BlurHash: BlurHash(out.Image[0]),
+	}, nil
+}
+
+// Merge palettes into one of up to 256 colors, earlier palettes take priority when there isn't room for every
+// color. If transparent is true a slot is kept for a transparent color, for the parts of the image that nothing
+// has been drawn on.
+func mergePalettes(transparent bool, palettes ...color.Palette) color.Palette {
+	merged := color.Palette{}
+	seen := make(map[color.RGBA64]bool)
+	hasTransparent := false
+	limit := func() int {
+		if transparent && !hasTransparent {
+			return 255
+		}
+		return 256
+	}
+	for _, p := range palettes {
+		for _, c := range p {
+			rgba := color.RGBA64Model.Convert(c).(color.RGBA64)
+			if seen[rgba] || (rgba.A != 0 && len(merged) >= limit()) || len(merged) >= 256 {
+				continue
+			}
+			seen[rgba] = true
+			merged = append(merged, c)
+			if rgba.A == 0 {
+				hasTransparent = true
+			}
+		}
+		if len(merged) >= limit() {
+			break
+		}
+	}
+	if transparent && !hasTransparent {
+		merged = append(merged, color.Transparent)
+	}
+	return merged
+}
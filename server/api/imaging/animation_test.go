@@ -0,0 +1,137 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+// encode a GIF with the given number of frames, with or without a global color table
+func testGIF(t *testing.T, frames int, globalPalette bool) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White, color.RGBA{255, 0, 0, 255}}
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+		frame.SetColorIndex(i%4, i%4, uint8(i%len(palette)))
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	if globalPalette {
+		g.Config = image.Config{ColorModel: palette, Width: 4, Height: 4}
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	tests := []struct {
+		name          string
+		frames        int
+		globalPalette bool
+	}{
+		{"single frame", 1, false},
+		{"animation", 12, false},
+		{"global color table", 5, true},
+	}
+	for _, test := range tests {
+		data := testGIF(t, test.frames, test.globalPalette)
+		frames, err := countGIFFrames(bytes.NewReader(data))
+		if err != nil || frames != test.frames {
+			t.Errorf("%v: countGIFFrames = %d, %v, want %d", test.name, frames, err, test.frames)
+		}
+	}
+
+	data := testGIF(t, 3, false)
+	bad := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"header only", data[:13]},
+		{"truncated", data[:len(data)-4]},
+		{"no trailer", data[:len(data)-1]},
+		{"unknown block", append(append([]byte{}, data[:len(data)-1]...), 0x99)},
+	}
+	for _, test := range bad {
+		if frames, err := countGIFFrames(bytes.NewReader(test.data)); err == nil {
+			t.Errorf("%v: countGIFFrames = %d, want an error", test.name, frames)
+		}
+	}
+}
+
+func TestProcessAnimationKeepsEarlierColors(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	//the first frame covers the image in red, the second only draws a blue square in the corner with a palette
+	//that has no red in it
+	first := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{red})
+	second := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{blue})
+	g := &gif.GIF{
+		Image:    []*image.Paletted{first, second},
+		Delay:    []int{10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+		Config:   image.Config{Width: 8, Height: 8},
+	}
+	buf := &bytes.Buffer{}
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := gif.DecodeAll(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := processAnimation(decoded, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := gif.DecodeAll(bytes.NewReader(img.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Image) != 2 {
+		t.Fatalf("got %d frames, want 2", len(out.Image))
+	}
+	frame := out.Image[1]
+	if got := color.RGBAModel.Convert(frame.At(1, 1)); got != blue {
+		t.Errorf("second frame at 1,1 is %v, want blue", got)
+	}
+	if got := color.RGBAModel.Convert(frame.At(5, 5)); got != red {
+		t.Errorf("second frame at 5,5 is %v, want the red left by the first frame", got)
+	}
+}
+
+func TestMergePalettes(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	full := make(color.Palette, 256)
+	for i := range full {
+		full[i] = color.RGBA{uint8(i), 1, 1, 255}
+	}
+
+	merged := mergePalettes(false, color.Palette{red}, color.Palette{blue, red})
+	if len(merged) != 2 || merged[0] != red || merged[1] != blue {
+		t.Errorf("mergePalettes = %v, want red then blue", merged)
+	}
+
+	merged = mergePalettes(true, color.Palette{red})
+	if len(merged) != 2 || merged[1] != color.Transparent {
+		t.Errorf("mergePalettes with transparency = %v, want red then transparent", merged)
+	}
+
+	//a full palette keeps a slot for transparency and drops what doesn't fit
+	merged = mergePalettes(true, full, color.Palette{blue})
+	if len(merged) != 256 || merged[255] != color.Transparent || merged[254] != full[254] {
+		t.Errorf("mergePalettes of a full palette has %d colors ending in %v, want 256 ending in transparent", len(merged), merged[len(merged)-1])
+	}
+	merged = mergePalettes(false, full, color.Palette{blue})
+	if len(merged) != 256 || merged[255] != full[255] {
+		t.Errorf("mergePalettes of a full palette without transparency has %d colors, want the 256 of the first", len(merged))
+	}
+}
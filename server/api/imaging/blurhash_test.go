@@ -0,0 +1,92 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func solidImage(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// black on the left to white on the right
+func gradientImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(x * 255 / (w - 1))
+			img.Set(x, y, color.NRGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+// red, green, blue and white blocks split at splitX and splitY
+func blocksImage(size, splitX, splitY int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			c := color.NRGBA{255, 255, 255, 255}
+			switch {
+			case x < splitX && y < splitY:
+				c = color.NRGBA{255, 0, 0, 255}
+			case y < splitY:
+				c = color.NRGBA{0, 255, 0, 255}
+			case x < splitX:
+				c = color.NRGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestBlurHash(t *testing.T) {
+	//expected hashes are from a separate port of the reference TypeScript encoder
+	tests := []struct {
+		name string
+		img  image.Image
+		want string
+	}{
+		{"black", solidImage(8, 8, color.Black), "L00000" + strings.Repeat("fQ", 11)},
+		{"white", solidImage(8, 8, color.White), "LfTSUA~qfQ~q~qt7fQt7fQfQfQfQ"},
+		{"red", solidImage(8, 8, color.NRGBA{255, 0, 0, 255}), "LfTI:j|cfQ|c|csUfQsUfQfQfQfQ"},
+		{"gradient", gradientImage(32, 32), "L$HetW00xuWBofWBj[fQfQfQfQfQ"},
+		{"blocks", blocksImage(16, 5, 7), "L~L~5UdhQarxKV;N+{s9N:wvwxn~"},
+		{"transparent keeps its color", solidImage(8, 8, color.NRGBA{255, 0, 0, 0}), "LfTI:j|cfQ|c|csUfQsUfQfQfQfQ"},
+		{"empty", image.NewNRGBA(image.Rect(0, 0, 0, 0)), ""},
+	}
+	for _, test := range tests {
+		if got := BlurHash(test.img); got != test.want {
+			t.Errorf("%v: BlurHash = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBlurHashBounds(t *testing.T) {
+	//an image that doesn't start at 0,0 gets the same hash as the same pixels starting at 0,0
+	big := blocksImage(32, 16, 16)
+	sub := big.SubImage(image.Rect(8, 8, 24, 24))
+	moved := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			moved.Set(x, y, big.At(x+8, y+8))
+		}
+	}
+	if got, want := BlurHash(sub), BlurHash(moved); got != want {
+		t.Errorf("BlurHash of a sub image = %q, want %q", got, want)
+	}
+
+	//images wider than the sample width are shrunk first, the hash still has 4x3 components
+	if got := BlurHash(gradientImage(640, 480)); len(got) != 28 || got[:1] != "L" {
+		t.Errorf("BlurHash of a large image = %q, want 28 characters starting with L", got)
+	}
+}
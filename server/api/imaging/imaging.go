@@ -0,0 +1,207 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/nfnt/resize"
+	_ "golang.org/x/image/webp"
+)
+
+/*
+Uploaded images (pfps, room images and image attachments) all go through Process. The format comes from the
+first bytes of the file, never the Content-Type sent by the client. JPEG, PNG, GIF and WebP can be decoded.
+
+Images are always encoded again, which leaves behind all of their metadata (EXIF, including GPS positions, and
+text chunks). The orientation from the EXIF data is applied to the pixels first so phone photos are the right way
+up. Animated GIFs stay animated GIFs, images with transparency are saved as PNG and everything else as JPEG.
+Animated WebPs can't be decoded.
+*/
+
+const MaxPixels = 40 * 1000 * 1000          //40 megapixels, checked before decoding so a small file can't make the server allocate huge images
+const MaxAnimationPixels = 50 * 1000 * 1000 //the pixels of every frame of an animation added together
+
+var ErrUnsupportedFormat = errors.New("Unrecognized / unsupported format")
+var ErrInvalidImage = errors.New("The image could not be read")
+var ErrTooManyPixels = errors.New("Image dimensions too large. Max 40 megapixels.")
+
+// Detect the format of an image from its first bytes, "jpeg", "png", "gif", "webp" or "" if it isn't one of them
+func DetectFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return "gif"
+	case len(header) >= 12 && bytes.HasPrefix(header, []byte("RIFF")) && string(header[8:12]) == "WEBP":
+		return "webp"
+	}
+	return ""
+}
+
+// Detect the format of the image at the start of r, then go back to the start
+func DetectReader(r io.ReadSeeker) (string, error) {
+	header := make([]byte, 12)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return DetectFormat(header[:n]), nil
+}
+
+// The mime type of an encoded image, from its first bytes
+func MimeType(data []byte) string {
+	if format := DetectFormat(data); format != "" {
+		return "image/" + format
+	}
+	return "application/octet-stream"
+}
+
+// A data URL for an encoded image, for sending small images like pfps over the websocket and in JSON
+func DataURL(data []byte) string {
+	return "data:" + MimeType(data) + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// A width images are shrunk to. Image attachments are saved at Full and the smaller sizes are made from that.
+type Size struct {
+	Name     string
+	MaxWidth uint
+}
+
+var (
+	Thumb  = Size{"thumb", 150}
+	Medium = Size{"medium", 350}
+	Full   = Size{"full", 1600}
+)
+
+// Find a size by its name, only the sizes smaller than Full since that's what is saved
+func DerivativeSize(name string) (Size, bool) {
+	switch name {
+	case Thumb.Name:
+		return Thumb, true
+	case Medium.Name:
+		return Medium, true
+	}
+	return Size{}, false
+}
+
+type Image struct {
+	Data     []byte
+	MimeType string // image/jpeg, image/png or image/gif
+	Width    int
+	Height   int
+	Frames   int         // more than 1 for animated GIFs
+	Preview  image.Image // the (first frame of the) processed image, for making blurs from
+	BlurHash string
+}
+
+// Decode the image, fix its orientation, shrink it to maxWidth if it's wider, and encode it again. Returns
+// ErrUnsupportedFormat, ErrInvalidImage or ErrTooManyPixels if it can't be used.
+func Process(r io.ReadSeeker, maxWidth uint) (*Image, error) {
+	format, err := DetectReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		return nil, ErrUnsupportedFormat
+	}
+
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	if int64(config.Width)*int64(config.Height) > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if format == "gif" {
+		//the frames are counted without decoding them so a long animation can't use up the memory either
+		frames, err := countGIFFrames(r)
+		if err != nil {
+			return nil, ErrInvalidImage
+		}
+		if int64(frames)*int64(config.Width)*int64(config.Height) > MaxAnimationPixels {
+			return nil, ErrTooManyPixels
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if frames > 1 {
+			g, err := gif.DecodeAll(r)
+			if err != nil {
+				return nil, ErrInvalidImage
+			}
+			return processAnimation(g, maxWidth)
+		}
+	}
+
+	orientation := 1
+	if format == "jpeg" {
+		if orientation, err = readOrientation(r); err != nil {
+			return nil, err
+		}
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, ErrInvalidImage
+	}
+	//shrunk before it's turned so the pixels are only copied at the smaller size. images that get turned a
+	//quarter are shrunk by their height, which becomes their width.
+	if orientation >= 5 && orientation <= 8 {
+		img = shrinkHeight(img, maxWidth)
+	} else {
+		img = shrink(img, maxWidth)
+	}
+	img = applyOrientation(img, orientation)
+
+	out := &Image{Width: img.Bounds().Dx(), Height: img.Bounds().Dy(), Frames: 1, Preview: img, BlurHash: BlurHash(img)}
+	buf := &bytes.Buffer{}
+	if isOpaque(img) {
+		out.MimeType = "image/jpeg"
+		err = jpeg.Encode(buf, img, nil)
+	} else {
+		//keeps the transparency
+		out.MimeType = "image/png"
+		err = png.Encode(buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("encoding image: %w", err)
+	}
+	out.Data = buf.Bytes()
+	return out, nil
+}
+
+func shrink(img image.Image, maxWidth uint) image.Image {
+	if maxWidth == 0 || uint(img.Bounds().Dx()) <= maxWidth {
+		return img
+	}
+	return resize.Resize(maxWidth, 0, img, resize.Lanczos2)
+}
+
+func shrinkHeight(img image.Image, maxHeight uint) image.Image {
+	if maxHeight == 0 || uint(img.Bounds().Dy()) <= maxHeight {
+		return img
+	}
+	return resize.Resize(0, maxHeight, img, resize.Lanczos2)
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
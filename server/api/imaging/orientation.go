@@ -0,0 +1,133 @@
+package imaging
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+)
+
+const exifOrientationTag = 0x0112
+
+// Find the EXIF orientation of a JPEG (1 to 8), then go back to the start. 1 is returned when there isn't one,
+// or the EXIF data can't be read, since the image can still be shown as it is.
+func readOrientation(r io.ReadSeeker) (int, error) {
+	orientation := jpegOrientation(bufio.NewReader(r))
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return orientation, nil
+}
+
+// go through the JPEG segments up to the image data looking for the EXIF one
+func jpegOrientation(r *bufio.Reader) int {
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return 1
+	}
+	for {
+		marker := make([]byte, 4)
+		if _, err := io.ReadFull(r, marker); err != nil || marker[0] != 0xff {
+			return 1
+		}
+		//start of scan, the image data follows and there are no more metadata segments
+		if marker[1] == 0xda {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 1
+		}
+		if marker[1] != 0xe1 {
+			if _, err := r.Discard(length); err != nil {
+				return 1
+			}
+			continue
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1
+		}
+		if len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+// read the orientation tag from the first IFD of the TIFF structure inside the EXIF segment
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			//a SHORT, stored in the first two bytes of the value
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// Turn and flip the image so it's shown the way the EXIF orientation says it should be
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		//5 to 8 are turned a quarter, so the width and height swap
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: //flipped horizontally
+				sx, sy = w-1-x, y
+			case 3: //upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: //flipped vertically
+				sx, sy = x, h-1-y
+			case 5: //flipped along the top left to bottom right diagonal
+				sx, sy = y, x
+			case 6: //needs turning clockwise
+				sx, sy = y, h-1-x
+			case 7: //flipped along the top right to bottom left diagonal
+				sx, sy = w-1-y, h-1-x
+			case 8: //needs turning anticlockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
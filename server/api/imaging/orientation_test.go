@@ -0,0 +1,109 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// a TIFF header followed by one IFD with the given tags, each a SHORT with one value
+func testTIFF(order byteOrder, tags map[uint16]uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	if order.String() == binary.BigEndian.String() {
+		tiff = []byte("MM\x00*\x00\x00\x00\x08")
+	}
+	tiff = order.AppendUint16(tiff, uint16(len(tags)))
+	//entries are sorted by tag, same as in real files
+	for tag := uint16(0); tag < 0xffff; tag++ {
+		value, ok := tags[tag]
+		if !ok {
+			continue
+		}
+		tiff = order.AppendUint16(tiff, tag)
+		tiff = order.AppendUint16(tiff, 3) //SHORT
+		tiff = order.AppendUint32(tiff, 1)
+		tiff = order.AppendUint16(tiff, value)
+		tiff = append(tiff, 0, 0)
+	}
+	return order.AppendUint32(tiff, 0) //no next IFD
+}
+
+func TestExifOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"little endian", testTIFF(binary.LittleEndian, map[uint16]uint16{exifOrientationTag: 6}), 6},
+		{"big endian", testTIFF(binary.BigEndian, map[uint16]uint16{exifOrientationTag: 3}), 3},
+		{"after other tags", testTIFF(binary.LittleEndian, map[uint16]uint16{0x010f: 1, 0x0110: 2, exifOrientationTag: 8}), 8},
+		{"no orientation tag", testTIFF(binary.LittleEndian, map[uint16]uint16{0x010f: 1}), 1},
+		{"orientation out of range", testTIFF(binary.LittleEndian, map[uint16]uint16{exifOrientationTag: 9}), 1},
+		{"orientation zero", testTIFF(binary.LittleEndian, map[uint16]uint16{exifOrientationTag: 0}), 1},
+		{"empty", nil, 1},
+		{"short header", []byte("II*\x00"), 1},
+		{"bad byte order", []byte("XX*\x00\x08\x00\x00\x00\x00\x00"), 1},
+		{"IFD past the end", []byte("II*\x00\xff\x00\x00\x00"), 1},
+		{"IFD inside the header", []byte("II*\x00\x02\x00\x00\x00\x00\x00"), 1},
+		{"truncated entries", testTIFF(binary.LittleEndian, map[uint16]uint16{exifOrientationTag: 6})[:16], 1},
+	}
+	for _, test := range tests {
+		if got := exifOrientation(test.tiff); got != test.want {
+			t.Errorf("%v: exifOrientation = %d, want %d", test.name, got, test.want)
+		}
+	}
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+			tiff := testTIFF(order, map[uint16]uint16{exifOrientationTag: uint16(orientation)})
+			if got := exifOrientation(tiff); got != orientation {
+				t.Errorf("%v orientation %d: exifOrientation = %d", order, orientation, got)
+			}
+		}
+	}
+}
+
+// a JPEG of the image with an EXIF segment holding the orientation
+func orientedJPEG(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := append([]byte("Exif\x00\x00"), testTIFF(binary.BigEndian, map[uint16]uint16{exifOrientationTag: orientation})...)
+	segment := []byte{0xff, 0xe1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)}
+	data := append([]byte{}, buf.Bytes()[:2]...)
+	data = append(data, segment...)
+	data = append(data, exif...)
+	return append(data, buf.Bytes()[2:]...)
+}
+
+func TestProcessOrientation(t *testing.T) {
+	wide := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	tests := []struct {
+		orientation   uint16
+		width, height int
+	}{
+		//shrunk to 50 wide
+		{1, 50, 13},
+		{3, 50, 13},
+		//turned a quarter, so it's 100 wide before shrinking
+		{6, 50, 200},
+		{8, 50, 200},
+	}
+	for _, test := range tests {
+		img, err := Process(bytes.NewReader(orientedJPEG(t, wide, test.orientation)), 50)
+		if err != nil {
+			t.Fatalf("orientation %d: %v", test.orientation, err)
+		}
+		if img.Width != test.width || img.Height != test.height {
+			t.Errorf("orientation %d: got %dx%d, want %dx%d", test.orientation, img.Width, img.Height, test.width, test.height)
+		}
+	}
+}
@@ -24,6 +24,8 @@ func Setup(app *fiber.App, chatServer *controllers.ChatServer, removeChatServerC
 		RouteName:     "updatepfp",
 	}), helpers.AuthMiddleware, controllers.HandleUpdatePfp(chatServer, protectedUids))
 	app.Post("/api/user/deleteacc", helpers.AuthMiddleware, controllers.HandleDeleteUser(protectedUids))
+	app.Get("/api/user/deleteacc", helpers.AuthMiddleware, controllers.HandleGetAccountDeletion)
+	app.Post("/api/user/deleteacc/cancel", helpers.AuthMiddleware, controllers.HandleCancelAccountDeletion)
 	app.Post("/api/user/refresh", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
 		Window:        time.Second * 120,
 		MaxReqs:       30,
@@ -31,12 +33,69 @@ func Setup(app *fiber.App, chatServer *controllers.ChatServer, removeChatServerC
 		RouteName:     "refresh",
 	}), controllers.HandleRefresh(removeChatServerConnByUID, production))
 	app.Post("/api/user/logout", controllers.HandleLogout(removeChatServerConnByUID))
+	//before /api/user/:id so "export" isn't taken as an id
+	app.Post("/api/user/export", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Minute * 10,
+		MaxReqs:       3,
+		BlockDuration: time.Minute * 10,
+		Message:       "You have requested too many data exports. Wait ten minutes.",
+		RouteName:     "requestdataexport",
+	}), helpers.AuthMiddleware, controllers.HandleRequestDataExport(chatServer))
+	app.Get("/api/user/export", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "getdataexport",
+	}), helpers.AuthMiddleware, controllers.HandleGetDataExport)
+	app.Get("/api/user/export/:id/download", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Minute,
+		MaxReqs:       5,
+		BlockDuration: time.Minute,
+		RouteName:     "downloaddataexport",
+	}), helpers.AuthMiddleware, controllers.HandleDownloadDataExport)
 	app.Get("/api/user/:id", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
 		Window:        time.Second * 10,
 		MaxReqs:       30,
 		BlockDuration: time.Second * 4,
 		RouteName:     "getuser",
-	}), helpers.AuthMiddleware, controllers.HandleGetUser)
+	}), helpers.AuthMiddleware, controllers.HandleGetUser(chatServer))
+	app.Get("/api/user/:id/pfp", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       60,
+		BlockDuration: time.Second * 4,
+		RouteName:     "getpfp",
+	}), helpers.AuthMiddleware, controllers.HandleGetPfp)
+
+	app.Post("/api/user/readreceipts", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       5,
+		BlockDuration: time.Second * 30,
+		RouteName:     "readreceiptsetting",
+	}), helpers.AuthMiddleware, controllers.HandleSetReadReceipts)
+	app.Get("/api/search", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "search",
+	}), helpers.AuthMiddleware, controllers.HandleSearchMessages)
+	app.Get("/api/notifications", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       20,
+		BlockDuration: time.Second * 30,
+		RouteName:     "getnotifications",
+	}), helpers.AuthMiddleware, controllers.HandleGetNotifications)
+	app.Post("/api/notifications/read", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       20,
+		BlockDuration: time.Second * 30,
+		RouteName:     "readnotifications",
+	}), helpers.AuthMiddleware, controllers.HandleMarkNotificationsRead)
+	app.Post("/api/notifications/:id/read", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       20,
+		BlockDuration: time.Second * 30,
+		RouteName:     "readnotifications",
+	}), helpers.AuthMiddleware, controllers.HandleMarkNotificationsRead)
 
 	app.Use("/ws", controllers.HandleWsUpgrade)
 	app.Get("/ws/conn", controllers.HandleWsConn(chatServer, removeChatServerConn))
@@ -77,6 +136,103 @@ func Setup(app *fiber.App, chatServer *controllers.ChatServer, removeChatServerC
 		BlockDuration: time.Minute,
 		RouteName:     "attachment",
 	}), helpers.AuthMiddleware, controllers.HandleUploadAttachment(chatServer))
+	app.Post("/api/room/:roomId/:msgId/upload", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       5,
+		BlockDuration: time.Minute,
+		RouteName:     "createupload",
+	}), helpers.AuthMiddleware, controllers.HandleCreateUpload(chatServer))
+	//resumable uploads send a request for every chunk so these allow more requests
+	app.Head("/api/upload/:id", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       20,
+		BlockDuration: time.Minute,
+		RouteName:     "uploadoffset",
+	}), helpers.AuthMiddleware, controllers.HandleGetUploadOffset)
+	app.Patch("/api/upload/:id", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       40,
+		BlockDuration: time.Minute,
+		RouteName:     "uploadchunk",
+	}), helpers.AuthMiddleware, controllers.HandleUploadChunk(chatServer))
+	app.Delete("/api/upload/:id", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       5,
+		BlockDuration: time.Minute,
+		RouteName:     "cancelupload",
+	}), helpers.AuthMiddleware, controllers.HandleCancelUpload(chatServer))
+	app.Patch("/api/room/:roomId/:msgId", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "editmessage",
+	}), helpers.AuthMiddleware, controllers.HandleEditMessage(chatServer))
+	app.Delete("/api/room/:roomId/:msgId", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "deletemessage",
+	}), helpers.AuthMiddleware, controllers.HandleDeleteMessage(chatServer))
+	app.Get("/api/room/:roomId/:msgId/history", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "messagehistory",
+	}), helpers.AuthMiddleware, controllers.HandleGetMessageHistory(chatServer))
+	app.Get("/api/room/:roomId/:msgId/thread", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       20,
+		BlockDuration: time.Second * 30,
+		RouteName:     "getthread",
+	}), helpers.AuthMiddleware, controllers.HandleGetThread(chatServer))
+	app.Get("/api/room/:id/members", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "getmembers",
+	}), helpers.AuthMiddleware, controllers.HandleGetRoomMembers(chatServer))
+	app.Get("/api/room/:id/receipts", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "getreceipts",
+	}), helpers.AuthMiddleware, controllers.HandleGetReadReceipts(chatServer))
+	app.Get("/api/room/:id/attachments", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "getattachments",
+	}), helpers.AuthMiddleware, controllers.HandleGetRoomAttachments)
+	app.Get("/api/room/:id/pins", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "getpins",
+	}), helpers.AuthMiddleware, controllers.HandleGetPinnedMessages(chatServer))
+	app.Post("/api/room/:roomId/:msgId/pin", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "pin",
+	}), helpers.AuthMiddleware, controllers.HandleSetPinned(chatServer, true))
+	app.Delete("/api/room/:roomId/:msgId/pin", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       10,
+		BlockDuration: time.Second * 30,
+		RouteName:     "pin",
+	}), helpers.AuthMiddleware, controllers.HandleSetPinned(chatServer, false))
+	app.Post("/api/room/:id/moderators/:uid", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       5,
+		BlockDuration: time.Second * 30,
+		RouteName:     "moderators",
+	}), helpers.AuthMiddleware, controllers.HandleSetModerator(protectedRids, true))
+	app.Delete("/api/room/:id/moderators/:uid", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       5,
+		BlockDuration: time.Second * 30,
+		RouteName:     "moderators",
+	}), helpers.AuthMiddleware, controllers.HandleSetModerator(protectedRids, false))
 	app.Get("/api/attachment/image/:id", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
 		Window:        time.Second * 10,
 		MaxReqs:       5,
@@ -89,6 +245,19 @@ func Setup(app *fiber.App, chatServer *controllers.ChatServer, removeChatServerC
 		BlockDuration: time.Minute,
 		RouteName:     "getattachment",
 	}), controllers.HandleDownloadAttachment)
+	//media players make a range request every time they seek so this allows more requests
+	app.Get("/api/attachment/view/:id", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       40,
+		BlockDuration: time.Minute,
+		RouteName:     "viewattachment",
+	}), controllers.HandleViewAttachment)
+	app.Get("/api/attachment/:id/links", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Second * 10,
+		MaxReqs:       40,
+		BlockDuration: time.Second * 10,
+		RouteName:     "attachmentlinks",
+	}), helpers.AuthMiddleware, controllers.HandleGetAttachmentLinks)
 	app.Post("/api/room/:id/join", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
 		Window:        time.Second * 10,
 		MaxReqs:       10,
@@ -114,4 +283,17 @@ func Setup(app *fiber.App, chatServer *controllers.ChatServer, removeChatServerC
 		Message:       "You have been creating too many rooms. Wait one minute.",
 		RouteName:     "createroom",
 	}), helpers.AuthMiddleware, controllers.HandleCreateRoom(chatServer))
+	app.Post("/api/rooms/import", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Minute,
+		MaxReqs:       3,
+		BlockDuration: time.Minute,
+		Message:       "You have been importing too many rooms. Wait one minute.",
+		RouteName:     "importroom",
+	}), helpers.AuthMiddleware, controllers.HandleImportRoom(chatServer))
+	app.Get("/api/room/:id/export", mylimiter.SimpleLimiterMiddleware(ipBlockInfoMap, mylimiter.SimpleLimiterOpts{
+		Window:        time.Minute,
+		MaxReqs:       3,
+		BlockDuration: time.Minute,
+		RouteName:     "exportroom",
+	}), helpers.AuthMiddleware, controllers.HandleExportRoom)
 }
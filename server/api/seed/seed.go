@@ -9,11 +9,14 @@ import (
 	"image/jpeg"
 	"log"
 	"math/rand"
+	"time"
 
 	"github.com/nfnt/resize"
 	"github.com/web-stuff-98/golang-chat-learning-project/api/helpers"
+	"github.com/web-stuff-98/golang-chat-learning-project/api/imaging"
 	"github.com/web-stuff-98/golang-chat-learning-project/db"
 	"github.com/web-stuff-98/golang-chat-learning-project/models"
+	"github.com/web-stuff-98/golang-chat-learning-project/storage"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -67,16 +70,15 @@ func generateUser(i uint8) (uid primitive.ObjectID, err error) {
 		return primitive.NilObjectID, err
 	}
 	inserted, err := db.UserCollection.InsertOne(context.TODO(), models.User{
-		Username: fmt.Sprintf("TestAcc%d", i+1),
-		Password: "$2a$12$VyvB4n4y8eq6mX8of9A3OOv/FRSzxSe54sk6ptifiT82RMtGpPI4a",
+		Username:    fmt.Sprintf("TestAcc%d", i+1),
+		Password:    "$2a$12$VyvB4n4y8eq6mX8of9A3OOv/FRSzxSe54sk6ptifiT82RMtGpPI4a",
+		PfpBlurHash: imaging.BlurHash(img),
+		PfpVersion:  time.Now().UnixMilli(),
 	})
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
-	if db.PfpCollection.InsertOne(context.TODO(), models.Pfp{
-		ID:     inserted.InsertedID.(primitive.ObjectID),
-		Binary: primitive.Binary{Data: buf.Bytes()},
-	}); err != nil {
+	if err := storage.Pfps.Save(context.TODO(), inserted.InsertedID.(primitive.ObjectID), buf.Bytes()); err != nil {
 		return primitive.NilObjectID, err
 	}
 	buf = nil
@@ -104,18 +106,18 @@ func generateRoom(i uint8, uid primitive.ObjectID) (rid primitive.ObjectID, err
 		return primitive.NilObjectID, err
 	}
 	inserted, err := db.RoomCollection.InsertOne(context.TODO(), models.Room{
-		Name:     fmt.Sprintf("Room %d", i+1),
-		Author:   uid,
-		Messages: []models.Message{},
-		ImgBlur:  "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(blurBuf.Bytes()),
+		Name:        fmt.Sprintf("Room %d", i+1),
+		Author:      uid,
+		Messages:    []models.Message{},
+		ImgBlur:     "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(blurBuf.Bytes()),
+		ImgBlurHash: imaging.BlurHash(img),
+		Moderators:  []primitive.ObjectID{},
+		Tags:        []string{},
 	})
 	if err != nil {
 		return primitive.NilObjectID, err
 	}
-	if db.RoomImageCollection.InsertOne(context.TODO(), models.RoomImage{
-		ID:     inserted.InsertedID.(primitive.ObjectID),
-		Binary: primitive.Binary{Data: buf.Bytes()},
-	}); err != nil {
+	if err := storage.RoomImages.Save(context.TODO(), inserted.InsertedID.(primitive.ObjectID), buf.Bytes()); err != nil {
 		return primitive.NilObjectID, err
 	}
 	return inserted.InsertedID.(primitive.ObjectID), nil
@@ -6,5 +6,14 @@ type Credentials struct {
 }
 
 type Room struct {
-	Name string `json:"name" validate:"required"`
+	Name string   `json:"name" validate:"required"`
+	Tags []string `json:"tags"`
+}
+
+type MessageUpdate struct {
+	Content string `json:"content" validate:"required"`
+}
+
+type ReadReceiptsSetting struct {
+	Enabled bool `json:"enabled"`
 }
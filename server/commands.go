@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/api/archive"
+	"github.com/web-stuff-98/golang-chat-learning-project/api/controllers"
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+	"github.com/web-stuff-98/golang-chat-learning-project/storage"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const commandUsage = `usage:
+  export-room <room id> <output file>     write a zip archive of the room
+  import-room <archive file> <username>   recreate a room from an archive, owned by the user
+  migrate-blobs                           move pfps, room images and attachments out of MongoDB into the
+                                          blob store set with BLOB_STORAGE, including attachments still in the
+                                          old attachments collection. can be run while the server is up`
+
+// Run one of the maintenance commands instead of starting the server
+func runCommand(args []string) error {
+	switch args[0] {
+	case "export-room":
+		if len(args) != 3 {
+			return errors.New(commandUsage)
+		}
+		roomId, err := primitive.ObjectIDFromHex(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid room id : %w", err)
+		}
+		out, err := os.Create(args[2])
+		if err != nil {
+			return err
+		}
+		if err := archive.Export(context.TODO(), roomId, out); err != nil {
+			out.Close()
+			os.Remove(args[2])
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		log.Println("Exported room to", args[2])
+	case "import-room":
+		if len(args) != 3 {
+			return errors.New(commandUsage)
+		}
+		var user models.User
+		if err := db.UserCollection.FindOne(context.TODO(), bson.M{"username": args[2]}).Decode(&user); err != nil {
+			return fmt.Errorf("could not find user %v : %w", args[2], err)
+		}
+		in, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		info, err := in.Stat()
+		if err != nil {
+			return err
+		}
+		roomId, err := archive.Import(context.TODO(), in, info.Size(), user.ID, archive.ImportOptions{MatchUsers: true, Validate: controllers.ValidateArchiveRoom})
+		if err != nil {
+			return err
+		}
+		log.Println("Imported room", roomId.Hex())
+	case "migrate-blobs":
+		if len(args) != 1 {
+			return errors.New(commandUsage)
+		}
+		if err := storage.Migrate(context.TODO()); err != nil {
+			return err
+		}
+	default:
+		return errors.New(commandUsage)
+	}
+	return nil
+}
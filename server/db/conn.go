@@ -19,7 +19,16 @@ var PfpCollection *mongo.Collection
 var SessionCollection *mongo.Collection
 var RoomCollection *mongo.Collection
 var RoomImageCollection *mongo.Collection
-var AttachmentCollection *mongo.Collection
+var AttachmentCollection *mongo.Collection       //the files collection of the attachments GridFS bucket
+var AttachmentChunkCollection *mongo.Collection  //the chunks collection of the attachments GridFS bucket
+var LegacyAttachmentCollection *mongo.Collection //attachments from before GridFS, with their data in the document
+var NotificationCollection *mongo.Collection
+var ReadStateCollection *mongo.Collection
+var DataExportCollection *mongo.Collection
+var AccountDeletionCollection *mongo.Collection
+var BlobCollection *mongo.Collection
+var UploadCollection *mongo.Collection
+var UploadChunkCollection *mongo.Collection
 
 func Connect() {
 	log.Println("Connecting to MongoDB...")
@@ -27,7 +36,8 @@ func Connect() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 	err = client.Connect(ctx)
 	if err != nil {
 		log.Fatal(err)
@@ -45,5 +55,16 @@ func Connect() {
 	SessionCollection = DB.Collection("sessions")
 	RoomCollection = DB.Collection("rooms")
 	RoomImageCollection = DB.Collection("roompics")
-	AttachmentCollection = DB.Collection("attachments")
+	AttachmentCollection = DB.Collection("attachments.files")
+	AttachmentChunkCollection = DB.Collection("attachments.chunks")
+	LegacyAttachmentCollection = DB.Collection("attachments")
+	NotificationCollection = DB.Collection("notifications")
+	ReadStateCollection = DB.Collection("read_states")
+	DataExportCollection = DB.Collection("data_exports")
+	AccountDeletionCollection = DB.Collection("account_deletions")
+	BlobCollection = DB.Collection("blobs")
+	UploadCollection = DB.Collection("uploads")
+	UploadChunkCollection = DB.Collection("upload_chunks")
+
+	checkTransactionsSupported(ctx)
 }
@@ -0,0 +1,36 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GridFS buckets share their read and write buffers so they aren't safe to use from more than one goroutine,
+// a new one is made each time one is needed.
+
+// personal data exports, the file id is the same as the DataExport id
+func ExportBucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(DB, options.GridFSBucket().SetName("exports"))
+}
+
+// message attachments, the mime type and message id are in the metadata. older ones have the id of their message.
+func AttachmentBucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(DB, options.GridFSBucket().SetName("attachments"))
+}
+
+// Delete attachment files and their chunks. Unlike Bucket.Delete this works inside a transaction.
+func DeleteAttachments(ctx context.Context, ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	//chunks first so a file is never left with missing chunks
+	if _, err := AttachmentChunkCollection.DeleteMany(ctx, bson.M{"files_id": bson.M{"$in": ids}}); err != nil {
+		return err
+	}
+	_, err := AttachmentCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
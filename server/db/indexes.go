@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Create the indexes the app needs. Creating an index that already exists does nothing, so this runs on startup
+// and again after the seed, which drops the database.
+func CreateIndexes() error {
+	//text index for searching message content
+	_, err := RoomCollection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "messages.content", Value: "text"}},
+		Options: options.Index().SetName("messages_content_text"),
+	})
+	if err != nil {
+		return err
+	}
+	//attachments are checked against the room their message is in
+	_, err = RoomCollection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "messages._id", Value: 1}},
+		Options: options.Index().SetName("messages_id"),
+	})
+	if err != nil {
+		return err
+	}
+	//blobs are released by their key
+	_, err = BlobCollection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetName("blobs_key").SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+	//only one chunk can be saved at each offset of an upload
+	_, err = UploadChunkCollection.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "upload_id", Value: 1}, {Key: "offset", Value: 1}},
+		Options: options.Index().SetName("upload_chunks_upload_id_offset").SetUnique(true),
+	})
+	return err
+}
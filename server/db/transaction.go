@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// transactions only work on replica sets and sharded clusters, set by Connect
+var TransactionsSupported bool
+
+func checkTransactionsSupported(ctx context.Context) {
+	var hello bson.M
+	if err := DB.RunCommand(ctx, bson.M{"hello": 1}).Decode(&hello); err != nil {
+		log.Println("Could not check if transactions are supported, assuming they are not : ", err)
+		return
+	}
+	_, isReplicaSet := hello["setName"]
+	TransactionsSupported = isReplicaSet || hello["msg"] == "isdbgrid"
+	if !TransactionsSupported {
+		log.Println("MongoDB is a standalone server, transactions are disabled")
+	}
+}
+
+// Run fn in a transaction, retrying on transient errors. fn has to use the ctx it's given for its queries. On a
+// standalone server fn is run without a transaction, so it should do the writes that matter most last.
+func WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if !TransactionsSupported {
+		return fn(ctx)
+	}
+	session, err := MongoClient.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	return err
+}
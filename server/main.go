@@ -5,15 +5,18 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/web-stuff-98/golang-chat-learning-project/api/controllers"
+	"github.com/web-stuff-98/golang-chat-learning-project/api/helpers"
 	"github.com/web-stuff-98/golang-chat-learning-project/api/mylimiter"
 	"github.com/web-stuff-98/golang-chat-learning-project/api/routes"
 	"github.com/web-stuff-98/golang-chat-learning-project/api/seed"
 	"github.com/web-stuff-98/golang-chat-learning-project/db"
 	"github.com/web-stuff-98/golang-chat-learning-project/models"
+	"github.com/web-stuff-98/golang-chat-learning-project/storage"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -30,12 +33,26 @@ func main() {
 	}
 
 	app := fiber.New(fiber.Config{
-		BodyLimit: 20 * 1024 * 1024, //largest file allowed to upload is 20mb
+		BodyLimit:         20 * 1024 * 1024, //largest body held in memory is 20mb, attachments bigger than this are streamed
+		StreamRequestBody: true,
 	})
+	//only attachment uploads and room imports can be bigger than the body limit, the handlers check the size themselves
+	app.Use(helpers.LargeBodyMiddleware(20*1024*1024, regexp.MustCompile(`^(/api/room/[^/]+/[^/]+/attachment|/api/rooms/import)$`)))
 
 	app.Static("/", "./build")
 
 	db.Connect()
+	if err := storage.Setup(); err != nil {
+		log.Fatal("Blob storage error : ", err)
+	}
+
+	/* -------- Run a command instead of the server if one was given (before the seed drops the DB) -------- */
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	/* -------- Create map to store client IP addresses and associated data used by rate limiter -------- */
 	ipBlockInfoMap := make(map[string]map[string]mylimiter.BlockInfo)
@@ -55,6 +72,11 @@ func main() {
 		log.Fatal(fmt.Printf("Failed to setup chat server : %d", err))
 	}
 
+	/* -------- Create indexes -------- */
+	if err := db.CreateIndexes(); err != nil {
+		log.Fatal("Index error : ", err)
+	}
+
 	/* -------- Generate seed and store ids in memory -------- */
 	var seedErr error
 	go func() {
@@ -66,12 +88,15 @@ func main() {
 		if seedErr != nil {
 			log.Fatal("Seed error : ", seedErr)
 		}
+		if err := db.CreateIndexes(); err != nil {
+			log.Fatal("Index error : ", err)
+		}
 	}()
 
 	/* -------- Set up routes with all the data needed sent down -------- */
 	routes.Setup(app, chatServer, removeChatServerConnByUID, removeChatServerConn, &uids, &rids, ipBlockInfoMap, production)
 
-	/* -------- Every 2 minutes clean up sessions, ipBlockInfo, and delete old messages -------- */
+	/* -------- Every 2 minutes clean up sessions, expired data exports, abandoned uploads, ipBlockInfo, and delete old messages -------- */
 	cleanupTicker := time.NewTicker(2 * time.Minute)
 	quitCleanup := make(chan struct{})
 	go func() {
@@ -79,6 +104,12 @@ func main() {
 			select {
 			case <-cleanupTicker.C:
 				db.SessionCollection.DeleteMany(context.TODO(), bson.M{"exp": bson.M{"$lt": primitive.NewDateTimeFromTime(time.Now())}})
+				if err := controllers.DeleteDataExports(context.TODO(), bson.M{"expires_at": bson.M{"$lt": primitive.NewDateTimeFromTime(time.Now())}}); err != nil {
+					log.Println("Data export cleanup error : ", err)
+				}
+				if err := controllers.ExpireUploads(context.TODO(), chatServer); err != nil {
+					log.Println("Upload cleanup error : ", err)
+				}
 				for ip, routeBlockInfoMap := range ipBlockInfoMap {
 					for routeName, blockInfo := range routeBlockInfoMap {
 						if blockInfo.RequestsInWindow >= blockInfo.OptsUsed.MaxReqs && time.Now().After(blockInfo.LastRequest.Add(blockInfo.OptsUsed.BlockDuration)) {
@@ -100,7 +131,18 @@ func main() {
 					if err != nil {
 						log.Fatal("ERROR DECODING : ", err)
 					}
+					//threads are deleted with their parent, so a parent is kept while a reply in it is pinned
+					pinnedThreads := make(map[primitive.ObjectID]bool)
+					for _, m := range room.Messages {
+						if m.Pinned && m.ParentID != nil {
+							pinnedThreads[*m.ParentID] = true
+						}
+					}
 					for _, m := range room.Messages {
+						//pinned messages are kept until they are unpinned
+						if m.Pinned || pinnedThreads[m.ID] {
+							continue
+						}
 						if m.Timestamp.Time().Before(time.Now().Add(-time.Minute * 20)) {
 							deleteMsgChan <- controllers.RoomIdMessageId{
 								RoomId:    room.ID,
@@ -117,7 +159,7 @@ func main() {
 		}
 	}()
 
-	/* -------- Delete accounts older than 20 minutes (changestream delete event will trigger deleting the users rooms and messages also) -------- */
+	/* -------- Delete accounts older than 20 minutes (starts a deletion job that deletes the users rooms and messages also) -------- */
 	oldAccountCleanupTicker := time.NewTicker(120 * time.Second)
 	quitOldAccountCleanup := make(chan struct{})
 	go func() {
@@ -149,9 +191,26 @@ func main() {
 			}
 		}
 	}()
+	/* -------- Every 10 minutes delete attachments, room images, pfps and blobs that were left without an owner -------- */
+	orphanCleanupTicker := time.NewTicker(10 * time.Minute)
+	quitOrphanCleanup := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-orphanCleanupTicker.C:
+				if err := controllers.ReconcileOrphans(context.TODO()); err != nil {
+					log.Println("Orphan cleanup error : ", err)
+				}
+			case <-quitOrphanCleanup:
+				orphanCleanupTicker.Stop()
+				return
+			}
+		}
+	}()
 	defer func() {
 		close(quitCleanup)
 		close(quitOldAccountCleanup)
+		close(quitOrphanCleanup)
 	}()
 
 	go watchForDeletesInUserCollection(db.UserCollection, deleteUserChan)
@@ -159,7 +218,8 @@ func main() {
 	log.Fatal(app.Listen(fmt.Sprint(":", os.Getenv("PORT"))))
 }
 
-// Watch for deletions in users collection... need to delete their messages and rooms and send the delete ws event to other users
+// Watch for deletions in users collection... need to delete their messages and rooms and send the delete ws event to other users.
+// Users deleted by a deletion job come through here too, the job is already running or done so nothing happens again.
 func watchForDeletesInUserCollection(collection *mongo.Collection, deleteUserChan chan string) {
 	userDeletePipeline := bson.D{
 		{
@@ -3,15 +3,21 @@ package models
 import "go.mongodb.org/mongo-driver/bson/primitive"
 
 type User struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty"`
-	Username  string             `bson:"username,maxlength=15" json:"username"`
-	Password  string             `bson:"password" json:"-"`
-	Base64pfp string             `bson:"-" json:"base64pfp,omitempty"`
+	ID                primitive.ObjectID `bson:"_id,omitempty"`
+	Username          string             `bson:"username,maxlength=15" json:"username"`
+	Password          string             `bson:"password" json:"-"`
+	PfpURL            string             `bson:"-" json:"pfp_url,omitempty"`
+	PfpVersion        int64              `bson:"pfp_version,omitempty" json:"-"`                 // when the pfp was last changed in unix milliseconds, for the version in PfpURL
+	ShareReadReceipts bool               `bson:"share_read_receipts" json:"share_read_receipts"` // if true other users in the room see how far this user has read
+	LastSeen          primitive.DateTime `bson:"last_seen,omitempty" json:"last_seen,omitempty"` // set when the users socket disconnects
+	Presence          string             `bson:"-" json:"presence,omitempty"`                    // online, away or offline
+	PfpBlurHash       string             `bson:"pfp_blurhash,omitempty" json:"pfp_blurhash,omitempty"`
 }
 
 type Pfp struct {
-	ID     primitive.ObjectID `bson:"_id, omitempty"` //id should be the same id as the uid
-	Binary primitive.Binary   `bson:"binary"`
+	ID      primitive.ObjectID `bson:"_id, omitempty"` //id should be the same id as the uid
+	Binary  primitive.Binary   `bson:"binary,omitempty"`
+	BlobKey string             `bson:"blob_key,omitempty"` //set when the image is in the blob store instead of Binary
 }
 
 type Session struct {
@@ -21,41 +27,216 @@ type Session struct {
 }
 
 type Message struct {
-	ID                primitive.ObjectID `bson:"_id,omitempty" json:"ID"` // omitempty to protect against zeroed _id insertion
-	Content           string             `bson:"content,maxlength=200" json:"content"`
-	Uid               string             `bson:"uid" json:"uid"`
-	Timestamp         primitive.DateTime `bson:"timestamp" json:"timestamp"`
-	HasAttachment     bool               `bson:"has_attachment" json:"has_attachment"`
-	AttachmentPending bool               `bson:"attachment_pending" json:"attachment_pending"`
-	AttachmentType    string             `bson:"attachment_type" json:"attachment_type"`
-	AttachmentError   bool               `bson:"attachment_error" json:"attachment_error"`
+	ID                primitive.ObjectID              `bson:"_id,omitempty" json:"ID"` // omitempty to protect against zeroed _id insertion
+	Content           string                          `bson:"content,maxlength=200" json:"content"`
+	Uid               string                          `bson:"uid" json:"uid"`
+	Timestamp         primitive.DateTime              `bson:"timestamp" json:"timestamp"`
+	HasAttachment     bool                            `bson:"has_attachment" json:"has_attachment"`
+	AttachmentPending bool                            `bson:"attachment_pending" json:"attachment_pending"` // true while any of the attachments is still uploading
+	AttachmentType    string                          `bson:"attachment_type" json:"attachment_type"`       // the type of the first attachment
+	AttachmentError   bool                            `bson:"attachment_error" json:"attachment_error"`     // true if any of the attachments failed
+	Attachments       []MessageAttachment             `bson:"attachments,omitempty" json:"attachments,omitempty"`
+	EditedAt          primitive.DateTime              `bson:"edited_at,omitempty" json:"edited_at,omitempty"`
+	Edits             []MessageEdit                   `bson:"edits,omitempty" json:"edits,omitempty"`         // previous versions of the content, oldest first
+	Reactions         map[string][]primitive.ObjectID `bson:"reactions,omitempty" json:"-"`                   // emoji -> ids of users who reacted with it
+	ReactionCounts    []ReactionCount                 `bson:"-" json:"reactions,omitempty"`                   // aggregated from Reactions before sending to the client
+	ParentID          *primitive.ObjectID             `bson:"parent_id,omitempty" json:"parent_id,omitempty"` // set if the message is a reply in a thread
+	ReplyCount        int                             `bson:"reply_count,omitempty" json:"reply_count,omitempty"`
+	LastReplyAt       primitive.DateTime              `bson:"last_reply_at,omitempty" json:"last_reply_at,omitempty"`
+	ReplyTo           *QuotedMessage                  `bson:"reply_to,omitempty" json:"reply_to,omitempty"` // the message this one is quoting
+	Pinned            bool                            `bson:"pinned,omitempty" json:"pinned,omitempty"`     // pinned messages are not deleted by the cleanup
+	PinnedAt          primitive.DateTime              `bson:"pinned_at,omitempty" json:"pinned_at,omitempty"`
+	PinnedBy          string                          `bson:"pinned_by,omitempty" json:"pinned_by,omitempty"`
+}
+
+// one of the files attached to a message. messages from before there could be more than one have no list, their
+// attachment has the same id as the message.
+type MessageAttachment struct {
+	ID       primitive.ObjectID `bson:"_id" json:"ID"` // the id of the file in the attachments bucket
+	Name     string             `bson:"name" json:"name"`
+	Size     int64              `bson:"size" json:"size"`
+	MimeType string             `bson:"mime_type" json:"mime_type"`
+	Width    int                `bson:"width,omitempty" json:"width,omitempty"` // images only
+	Height   int                `bson:"height,omitempty" json:"height,omitempty"`
+	BlurHash string             `bson:"blurhash,omitempty" json:"blurhash,omitempty"`
+	Status   string             `bson:"status" json:"status"` // "pending", "complete" or "error"
+	//links signed for the user the message is sent to
+	URL      string `bson:"-" json:"url,omitempty"`
+	ViewURL  string `bson:"-" json:"view_url,omitempty"`  // only for types the browser can show
+	ThumbURL string `bson:"-" json:"thumb_url,omitempty"` // only for images
+}
+
+// a copy of the quoted message taken when the reply is sent, so the reply still makes sense after the original is deleted
+type QuotedMessage struct {
+	ID        primitive.ObjectID `bson:"_id" json:"ID"`
+	Uid       string             `bson:"uid" json:"uid"`
+	Content   string             `bson:"content" json:"content"` // truncated
+	Timestamp primitive.DateTime `bson:"timestamp" json:"timestamp"`
+}
+
+type ReactionCount struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"` // true if the user receiving the response is one of the reactors
+}
+
+type MessageEdit struct {
+	Content   string             `bson:"content" json:"content"`
+	Timestamp primitive.DateTime `bson:"timestamp" json:"timestamp"` // when this version was written
 }
 
 //socket message JSON from the client
+//if event_type is empty its a normal chat message, otherwise its a command (message_edit, message_delete, reaction_add, reaction_remove, thread_join, thread_leave, read_ack, typing_start, typing_stop, presence_away)
 type MessageEvent struct {
+	EventType     string `json:"event_type"`
+	ID            string `json:"ID"` //the message id, for commands that act on an existing message
 	Content       string `json:"content"`
 	HasAttachment bool   `json:"has_attachment"`
+	Emoji         string `json:"emoji"`
+	ParentID      string `json:"parent_id"` //set when sending a reply in a thread
+	ReplyTo       string `json:"reply_to"`  //set when quoting another message in the same room
 }
 
 type Room struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"ID"` // omitempty to protect against zeroed _id insertion
-	Name      string             `bson:"name,maxlength=24" json:"name"`
-	Author    primitive.ObjectID `bson:"author_id" json:"author_id"`
+	ID          primitive.ObjectID   `bson:"_id,omitempty" json:"ID"` // omitempty to protect against zeroed _id insertion
+	Name        string               `bson:"name,maxlength=24" json:"name"`
+	Author      primitive.ObjectID   `bson:"author_id" json:"author_id"`
+	CreatedAt   primitive.DateTime   `bson:"created_at" json:"created_at"`
+	UpdatedAt   primitive.DateTime   `bson:"updated_at" json:"updated_at"`
+	Messages    []Message            `bson:"messages" json:"messages"`
+	ImgBlur     string               `bson:"img_blur" json:"img_blur,omitempty"`
+	ImgBlurHash string               `bson:"img_blurhash,omitempty" json:"img_blurhash,omitempty"`
+	Moderators  []primitive.ObjectID `bson:"moderators" json:"moderators"` //the author is always a moderator, doesn't need to be in here
+	Tags        []string             `bson:"tags" json:"tags"`
+	//per user counts worked out when the room list is requested
+	UnreadCount  int `bson:"-" json:"unread_count"`
+	MentionCount int `bson:"-" json:"mention_count"`
+}
+
+// the room list without the messages
+type RoomSummary struct {
+	ID           primitive.ObjectID `json:"ID"`
+	Name         string             `json:"name"`
+	Author       primitive.ObjectID `json:"author_id"`
+	CreatedAt    primitive.DateTime `json:"created_at"`
+	UpdatedAt    primitive.DateTime `json:"updated_at"`
+	ImgBlur      string             `json:"img_blur,omitempty"`
+	ImgBlurHash  string             `json:"img_blurhash,omitempty"`
+	Tags         []string           `json:"tags"`
+	LastActivity primitive.DateTime `json:"last_activity"`
+	MessageCount int                `json:"message_count"`
+	MemberCount  int                `json:"member_count"`
+	UnreadCount  int                `json:"unread_count"`
+	MentionCount int                `json:"mention_count"`
+}
+
+// how far a user has read in a room
+type ReadState struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Uid        primitive.ObjectID `bson:"uid" json:"uid"`
+	RoomID     primitive.ObjectID `bson:"room_id" json:"room_id"`
+	LastReadID primitive.ObjectID `bson:"last_read_id" json:"last_read_id"`
+	UpdatedAt  primitive.DateTime `bson:"updated_at" json:"updated_at"`
+}
+
+type Notification struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	Uid       primitive.ObjectID `bson:"uid" json:"-"`     // the user being notified
+	Type      string             `bson:"type" json:"type"` // "mention" for @username, "here" for @here, "room" for @room
+	RoomID    primitive.ObjectID `bson:"room_id" json:"room_id"`
+	MessageID primitive.ObjectID `bson:"message_id" json:"message_id"`
+	AuthorUid string             `bson:"author_uid" json:"author_uid"`
+	Content   string             `bson:"content" json:"content"`
+	Read      bool               `bson:"read" json:"read"`
 	CreatedAt primitive.DateTime `bson:"created_at" json:"created_at"`
-	UpdatedAt primitive.DateTime `bson:"updated_at" json:"updated_at"`
-	Messages  []Message          `bson:"messages" json:"messages"`
-	ImgBlur   string             `bson:"img_blur" json:"img_blur,omitempty"`
+}
+
+// a personal data export requested by a user. the zip file is in the exports GridFS bucket with the same id.
+type DataExport struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	Uid       primitive.ObjectID `bson:"uid" json:"-"`
+	Status    string             `bson:"status" json:"status"`     // "pending", "ready" or "failed"
+	Token     string             `bson:"token,omitempty" json:"-"` // needed in the download link, so the link stops working when the export expires
+	CreatedAt primitive.DateTime `bson:"created_at" json:"created_at"`
+	ExpiresAt primitive.DateTime `bson:"expires_at" json:"expires_at"` // the export and its file are deleted after this
+}
+
+// a job that deletes a user and everything belonging to them. it goes through the steps in order and saves its
+// progress after each one, so if the server stops part way through it carries on from the same step.
+type AccountDeletion struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	Uid            primitive.ObjectID `bson:"uid" json:"-"`
+	Status         string             `bson:"status" json:"status"` // "scheduled", "running", "done", "cancelled" or "failed"
+	CompletedSteps []string           `bson:"completed_steps" json:"completed_steps"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	LastError      string             `bson:"last_error,omitempty" json:"-"`
+	CreatedAt      primitive.DateTime `bson:"created_at" json:"created_at"`
+	RunAt          primitive.DateTime `bson:"run_at" json:"run_at"`  // when the grace period ends, or when to retry after a failure
+	LockedUntil    primitive.DateTime `bson:"locked_until" json:"-"` // set while the job is being worked on so it isn't picked up twice
+	CompletedAt    primitive.DateTime `bson:"completed_at,omitempty" json:"completed_at,omitempty"`
+}
+
+// a resumable upload of a message attachment. the chunks are kept in UploadChunks until all of them have arrived.
+type Upload struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty" json:"ID"`
+	Uid          primitive.ObjectID `bson:"uid" json:"-"`
+	RoomId       primitive.ObjectID `bson:"room_id" json:"room_id"`
+	MsgId        primitive.ObjectID `bson:"msg_id" json:"msg_id"`
+	AttachmentId primitive.ObjectID `bson:"attachment_id" json:"attachment_id"`
+	Filename     string             `bson:"filename" json:"filename"`
+	Length       int64              `bson:"length" json:"length"`
+	Offset       int64              `bson:"offset" json:"offset"` // how many bytes have been received
+	Status       string             `bson:"status" json:"status"` // "uploading" or "processing"
+	CreatedAt    primitive.DateTime `bson:"created_at" json:"created_at"`
+	ExpiresAt    primitive.DateTime `bson:"expires_at" json:"expires_at"` // moved forward every time a chunk arrives
+}
+
+type UploadChunk struct {
+	ID       primitive.ObjectID `bson:"_id,omitempty"`
+	UploadID primitive.ObjectID `bson:"upload_id"`
+	Offset   int64              `bson:"offset"`
+	Data     primitive.Binary   `bson:"data"`
+}
+
+// a blob in the blob store, stored once for each distinct content. documents point to it by its key, and refs
+// counts how many do. it's deleted when the count gets to 0.
+type Blob struct {
+	ID        string             `bson:"_id"` // sha256 of the contents, in hex
+	Key       string             `bson:"key"`
+	Size      int64              `bson:"size"`
+	Refs      int                `bson:"refs"`
+	UpdatedAt primitive.DateTime `bson:"updated_at"` // when a reference was last added or dropped
 }
 
 type RoomImage struct {
-	ID     primitive.ObjectID `bson:"_id, omitempty"` //should be the same as the rooms id
-	Binary primitive.Binary   `bson:"binary"`
+	ID      primitive.ObjectID `bson:"_id, omitempty"` //should be the same as the rooms id
+	Binary  primitive.Binary   `bson:"binary,omitempty"`
+	BlobKey string             `bson:"blob_key,omitempty"` //set when the image is in the blob store instead of Binary
 }
 
+// the file document of an attachment in the attachments GridFS bucket, the data is in its chunks or the blob store
 type Attachment struct {
-	ID       primitive.ObjectID `bson:"_id,omitempty" json:"ID"` // ID should be the same as the message
-	Binary   primitive.Binary   `bson:"binary"`
-	MimeType string             `bson:"attachment_type" json:"-"`
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"ID"` // the same as the message for attachments without a MsgId
+	Length     int64              `bson:"length" json:"size"`
+	UploadDate primitive.DateTime `bson:"uploadDate" json:"-"`
+	Metadata   AttachmentMetadata `bson:"metadata" json:"-"`
+}
+
+type AttachmentMetadata struct {
+	MimeType    string             `bson:"attachment_type"`
+	BlobKey     string             `bson:"blob_key,omitempty"`    //set when the data is in the blob store instead of GridFS chunks
+	MsgId       primitive.ObjectID `bson:"msg_id,omitempty"`      //the message the attachment belongs to, not set on attachments from before messages could have more than one
+	Derivatives []ImageDerivative  `bson:"derivatives,omitempty"` //smaller sizes of image attachments, made the first time they're asked for
+}
+
+// a smaller size of an image attachment, always in the blob store
+type ImageDerivative struct {
+	Size     string `bson:"size"` //the name of the size, thumb or medium
+	BlobKey  string `bson:"blob_key"`
+	MimeType string `bson:"mime_type"`
+	Length   int64  `bson:"length"`
+	Width    int    `bson:"width"`
+	Height   int    `bson:"height"`
 }
 
 //this is for the socket event when a user updates their profile
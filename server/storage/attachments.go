@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Save an attachment of the message. A file document without chunks is added to the attachments GridFS bucket
+// pointing to the blob, so attachments are found the same way whether their data is in the blob store or in old
+// GridFS chunks.
+func PutAttachment(ctx context.Context, id primitive.ObjectID, msgId primitive.ObjectID, filename string, mimeType string, r io.Reader, size int64) error {
+	key, err := Put(ctx, r, size)
+	if err != nil {
+		return err
+	}
+	if _, err := db.AttachmentCollection.InsertOne(ctx, bson.M{
+		"_id":        id,
+		"length":     size,
+		"chunkSize":  255 * 1024,
+		"uploadDate": primitive.NewDateTimeFromTime(time.Now()),
+		"filename":   filename,
+		"metadata":   models.AttachmentMetadata{MimeType: mimeType, BlobKey: key, MsgId: msgId},
+	}); err != nil {
+		Release(ctx, key)
+		return err
+	}
+	return nil
+}
+
+// Open length bytes of the attachment starting at offset, or everything after offset if length is negative
+func OpenAttachment(ctx context.Context, attachment *models.Attachment, offset int64, length int64) (io.ReadCloser, error) {
+	if attachment.Metadata.BlobKey != "" {
+		return Blobs.Get(ctx, attachment.Metadata.BlobKey, offset, length)
+	}
+	bucket, err := db.AttachmentBucket()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := bucket.OpenDownloadStream(attachment.ID)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		//skips whole chunks without downloading them
+		if _, err := stream.Skip(offset); err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
+	return limitReadCloser(stream, length), nil
+}
+
+// matches the attachments of the messages, older attachments have the same id as their message instead of a msg_id
+func messageAttachmentsFilter(msgIds []primitive.ObjectID) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"_id": bson.M{"$in": msgIds}},
+		bson.M{"metadata.msg_id": bson.M{"$in": msgIds}},
+	}}
+}
+
+// Find the attachments of the messages, in the order they were uploaded
+func FindAttachments(ctx context.Context, msgIds []primitive.ObjectID) ([]models.Attachment, error) {
+	attachments := []models.Attachment{}
+	if len(msgIds) == 0 {
+		return attachments, nil
+	}
+	cursor, err := db.AttachmentCollection.Find(ctx, messageAttachmentsFilter(msgIds), options.Find().SetSort(bson.M{"uploadDate": 1}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cursor.All(ctx, &attachments); err != nil {
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// delete the attachment documents and chunks matching the filter, returning the keys of their blobs
+func removeAttachments(ctx context.Context, filter bson.M) ([]string, error) {
+	cursor, err := db.AttachmentCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var attachments []models.Attachment
+	if err := cursor.All(ctx, &attachments); err != nil {
+		return nil, err
+	}
+	ids := []primitive.ObjectID{}
+	//not distinct, attachments sharing a blob each have a reference to release
+	keys := []string{}
+	for _, attachment := range attachments {
+		ids = append(ids, attachment.ID)
+		if attachment.Metadata.BlobKey != "" {
+			keys = append(keys, attachment.Metadata.BlobKey)
+		}
+		for _, derivative := range attachment.Metadata.Derivatives {
+			keys = append(keys, derivative.BlobKey)
+		}
+	}
+	if err := db.DeleteAttachments(ctx, ids); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Delete the documents and chunks of the messages attachments only, works inside a transaction. The keys of their
+// blobs are returned so the blobs can be released once the documents are gone for good.
+func RemoveAttachments(ctx context.Context, msgIds []primitive.ObjectID) ([]string, error) {
+	if len(msgIds) == 0 {
+		return nil, nil
+	}
+	return removeAttachments(ctx, messageAttachmentsFilter(msgIds))
+}
+
+// Delete the attachments of the messages and release their blobs
+func DeleteAttachments(ctx context.Context, msgIds []primitive.ObjectID) error {
+	keys, err := RemoveAttachments(ctx, msgIds)
+	if err != nil {
+		return err
+	}
+	Release(ctx, keys...)
+	return nil
+}
+
+// Delete attachments by their own ids and release their blobs
+func DeleteAttachmentFiles(ctx context.Context, ids []primitive.ObjectID) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	keys, err := removeAttachments(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	Release(ctx, keys...)
+	return nil
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// contents to be uploaded, hashed before uploading so an identical blob can be found
+type content struct {
+	hash  string
+	body  io.ReadSeeker
+	start int64
+	close func()
+}
+
+// Hash r. Readers that can seek are read twice, anything else is copied to a temporary file while it's hashed
+// so it never has to be held in memory.
+func hashContent(r io.Reader, size int64) (*content, error) {
+	h := sha256.New()
+	c := &content{close: func() {}}
+	var n int64
+	var err error
+	if rs, ok := r.(io.ReadSeeker); ok {
+		if c.start, err = rs.Seek(0, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		c.body = rs
+		n, err = io.Copy(h, rs)
+	} else {
+		f, tempErr := os.CreateTemp("", "blob-*")
+		if tempErr != nil {
+			return nil, tempErr
+		}
+		c.body = f
+		c.close = func() {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		n, err = io.Copy(io.MultiWriter(h, f), r)
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("read %d bytes of %d", n, size)
+	}
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	c.hash = hex.EncodeToString(h.Sum(nil))
+	return c, nil
+}
+
+func (c *content) rewind() error {
+	_, err := c.body.Seek(c.start, io.SeekStart)
+	return err
+}
+
+// Save the contents of r to the blob store, or use the blob that already has the same contents. The key of the
+// blob is returned with a reference taken on it, which has to be given back with Release when the document
+// pointing to it is changed or deleted.
+func Put(ctx context.Context, r io.Reader, size int64) (string, error) {
+	c, err := hashContent(r, size)
+	if err != nil {
+		return "", err
+	}
+	defer c.close()
+	for {
+		var blob models.Blob
+		err := db.BlobCollection.FindOneAndUpdate(ctx, bson.M{"_id": c.hash}, bson.M{
+			"$inc": bson.M{"refs": 1},
+			"$set": bson.M{"updated_at": primitive.NewDateTimeFromTime(time.Now())},
+		}).Decode(&blob)
+		if err == nil {
+			return blob.Key, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return "", err
+		}
+
+		//every upload gets its own key, so if the last blob with the same contents is being deleted right
+		//now it doesn't delete this one
+		key := "blobs/" + c.hash + "/" + primitive.NewObjectID().Hex()
+		if err := c.rewind(); err != nil {
+			return "", err
+		}
+		if err := Blobs.Put(ctx, key, c.body, size); err != nil {
+			return "", err
+		}
+		_, err = db.BlobCollection.InsertOne(ctx, models.Blob{
+			ID:        c.hash,
+			Key:       key,
+			Size:      size,
+			Refs:      1,
+			UpdatedAt: primitive.NewDateTimeFromTime(time.Now()),
+		})
+		if err == nil {
+			return key, nil
+		}
+		Blobs.Delete(ctx, key)
+		if !mongo.IsDuplicateKeyError(err) {
+			return "", err
+		}
+		//the same contents were uploaded at the same time, go round again to use that blob instead
+	}
+}
+
+// Put for contents that are already in memory
+func PutBytes(ctx context.Context, data []byte) (string, error) {
+	return Put(ctx, bytes.NewReader(data), int64(len(data)))
+}
+
+// Give back a reference to each blob. Blobs with no references left are deleted. Failures are only logged,
+// whatever is left behind is removed by CollectGarbage.
+func Release(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := release(ctx, key); err != nil {
+			log.Println("Could not release blob", key, ":", err)
+		}
+	}
+}
+
+func release(ctx context.Context, key string) error {
+	var blob models.Blob
+	err := db.BlobCollection.FindOneAndUpdate(ctx, bson.M{"key": key}, bson.M{
+		"$inc": bson.M{"refs": -1},
+		"$set": bson.M{"updated_at": primitive.NewDateTimeFromTime(time.Now())},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&blob)
+	if err == mongo.ErrNoDocuments {
+		return releaseUnrecorded(ctx, key)
+	}
+	if err != nil || blob.Refs > 0 {
+		return err
+	}
+	//only deleted if nothing has taken a reference in the meantime. once it's gone Put uploads identical
+	//contents to a new key, so deleting this key can't affect them.
+	res, err := db.BlobCollection.DeleteOne(ctx, bson.M{"_id": blob.ID, "refs": bson.M{"$lte": 0}})
+	if err != nil || res.DeletedCount == 0 {
+		return err
+	}
+	return Blobs.Delete(ctx, key)
+}
+
+// Blobs from before they were stored by their contents have keys like "pfps/<id>/<random id>" and no record
+// in the blobs collection. Each one belonged to a single document, so it's deleted once nothing points to it.
+func releaseUnrecorded(ctx context.Context, key string) error {
+	if strings.HasPrefix(key, "blobs/") {
+		return nil
+	}
+	for _, ref := range blobReferences() {
+		err := ref.collection.FindOne(ctx, bson.M{ref.path: key}).Err()
+		if err == nil {
+			return nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return err
+		}
+	}
+	return Blobs.Delete(ctx, key)
+}
+
+// the prefixes of the keys blobs are stored under, the others are from before blobs were stored by their contents
+var blobPrefixes = []string{"blobs/", "pfps/", "roomimages/", "attachments/"}
+
+type blobReference struct {
+	collection *mongo.Collection
+	path       string
+}
+
+// the fields documents point to their blobs with
+func blobReferences() []blobReference {
+	return []blobReference{
+		{db.PfpCollection, "blob_key"},
+		{db.RoomImageCollection, "blob_key"},
+		{db.AttachmentCollection, "metadata.blob_key"},
+		{db.AttachmentCollection, "metadata.derivatives.blob_key"},
+	}
+}
+
+// Delete blobs that no document points to, for when a reference wasn't given back because the server stopped
+// or a release failed, and blobs in the store that were never recorded, under any of the key prefixes. Only blobs that haven't been touched for
+// minAge are deleted, so one that was just uploaded isn't deleted before its document is saved.
+func CollectGarbage(ctx context.Context, minAge time.Duration) (int, error) {
+	cutoff := time.Now().Add(-minAge)
+	//the store is listed first so a blob uploaded after is protected by being recorded below, or by minAge
+	stored := []BlobInfo{}
+	for _, prefix := range blobPrefixes {
+		blobs, err := Blobs.List(ctx, prefix)
+		if err != nil {
+			return 0, err
+		}
+		stored = append(stored, blobs...)
+	}
+
+	//the keys that are pointed to are found before the blobs are, a blob that gets a new reference in between
+	//has its updated_at changed so it's protected by minAge
+	pointedTo := make(map[string]bool)
+	for _, ref := range blobReferences() {
+		values, err := ref.collection.Distinct(ctx, ref.path, bson.M{})
+		if err != nil {
+			return 0, err
+		}
+		for _, v := range values {
+			if key, ok := v.(string); ok {
+				pointedTo[key] = true
+			}
+		}
+	}
+
+	deleted := 0
+	cursor, err := db.BlobCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	var blobs []models.Blob
+	if err := cursor.All(ctx, &blobs); err != nil {
+		return 0, err
+	}
+	recorded := make(map[string]bool)
+	for _, blob := range blobs {
+		recorded[blob.Key] = true
+		if pointedTo[blob.Key] || blob.UpdatedAt.Time().After(cutoff) {
+			continue
+		}
+		res, err := db.BlobCollection.DeleteOne(ctx, bson.M{"_id": blob.ID, "updated_at": blob.UpdatedAt})
+		if err != nil {
+			return deleted, err
+		}
+		if res.DeletedCount == 0 {
+			continue
+		}
+		if blob.Refs > 0 {
+			log.Printf("Blob %v had %d references left but nothing pointed to it", blob.Key, blob.Refs)
+		}
+		if err := Blobs.Delete(ctx, blob.Key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	//blobs with no record are either from before blobs had records, or uploads that were never recorded
+	for _, info := range stored {
+		if recorded[info.Key] || pointedTo[info.Key] || info.ModTime.After(cutoff) {
+			continue
+		}
+		if err := Blobs.Delete(ctx, info.Key); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
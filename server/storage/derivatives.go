@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/api/imaging"
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Get a smaller size of an image attachment, as an attachment that can be opened with OpenAttachment. It's made
+// and saved the first time it's asked for, after that the saved one is used.
+func AttachmentDerivative(ctx context.Context, attachment *models.Attachment, size imaging.Size) (*models.Attachment, error) {
+	if derivative := findDerivative(attachment, size); derivative != nil {
+		return derivative, nil
+	}
+
+	rc, err := OpenAttachment(ctx, attachment, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	img, err := imaging.Process(bytes.NewReader(data), size.MaxWidth)
+	if err != nil {
+		return nil, err
+	}
+	key, err := PutBytes(ctx, img.Data)
+	if err != nil {
+		return nil, err
+	}
+	derivative := models.ImageDerivative{
+		Size:     size.Name,
+		BlobKey:  key,
+		MimeType: img.MimeType,
+		Length:   int64(len(img.Data)),
+		Width:    img.Width,
+		Height:   img.Height,
+	}
+	//only added if another request didn't make the same size in the meantime
+	res, err := db.AttachmentCollection.UpdateOne(ctx, bson.M{
+		"_id":                       attachment.ID,
+		"metadata.derivatives.size": bson.M{"$ne": size.Name},
+	}, bson.M{"$push": bson.M{"metadata.derivatives": derivative}})
+	if err != nil {
+		Release(ctx, key)
+		return nil, err
+	}
+	if res.MatchedCount == 0 {
+		//use the one that was saved first. if the attachment was deleted this gives back mongo.ErrNoDocuments
+		Release(ctx, key)
+		var updated models.Attachment
+		if err := db.AttachmentCollection.FindOne(ctx, bson.M{"_id": attachment.ID}).Decode(&updated); err != nil {
+			return nil, err
+		}
+		if derivative := findDerivative(&updated, size); derivative != nil {
+			return derivative, nil
+		}
+		return nil, ErrNotFound
+	}
+	return derivativeAttachment(attachment, &derivative), nil
+}
+
+// the derivative of the size as an attachment of its own, or nil if it hasn't been made
+func findDerivative(attachment *models.Attachment, size imaging.Size) *models.Attachment {
+	for _, derivative := range attachment.Metadata.Derivatives {
+		if derivative.Size == size.Name {
+			return derivativeAttachment(attachment, &derivative)
+		}
+	}
+	return nil
+}
+
+func derivativeAttachment(attachment *models.Attachment, derivative *models.ImageDerivative) *models.Attachment {
+	return &models.Attachment{
+		ID:         attachment.ID,
+		Length:     derivative.Length,
+		UploadDate: attachment.UploadDate,
+		Metadata:   models.AttachmentMetadata{MimeType: derivative.MimeType, BlobKey: derivative.BlobKey},
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"regexp"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GridFSStore keeps blobs in a GridFS bucket in the database, with the key as the file name
+type GridFSStore struct {
+	Bucket string
+}
+
+// a new bucket each time, see the comment in db/gridfs.go
+func (s *GridFSStore) bucket() (*gridfs.Bucket, error) {
+	return gridfs.NewBucket(db.DB, options.GridFSBucket().SetName(s.Bucket))
+}
+
+func (s *GridFSStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	bucket, err := s.bucket()
+	if err != nil {
+		return err
+	}
+	_, err = bucket.UploadFromStream(key, r)
+	return err
+}
+
+func (s *GridFSStore) Get(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	bucket, err := s.bucket()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := bucket.OpenDownloadStreamByName(key)
+	if err != nil {
+		if err == gridfs.ErrFileNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if offset > 0 {
+		//skips whole chunks without downloading them
+		if _, err := stream.Skip(offset); err != nil {
+			stream.Close()
+			return nil, err
+		}
+	}
+	return limitReadCloser(stream, length), nil
+}
+
+func (s *GridFSStore) Delete(ctx context.Context, key string) error {
+	bucket, err := s.bucket()
+	if err != nil {
+		return err
+	}
+	cursor, err := bucket.Find(bson.M{"filename": key})
+	if err != nil {
+		return err
+	}
+	var files []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := bucket.Delete(f.ID); err != nil && err != gridfs.ErrFileNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GridFSStore) List(ctx context.Context, prefix string) ([]BlobInfo, error) {
+	bucket, err := s.bucket()
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := bucket.Find(bson.M{"filename": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}})
+	if err != nil {
+		return nil, err
+	}
+	var files []struct {
+		Name       string             `bson:"filename"`
+		Length     int64              `bson:"length"`
+		UploadDate primitive.DateTime `bson:"uploadDate"`
+	}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	blobs := []BlobInfo{}
+	for _, f := range files {
+		blobs = append(blobs, BlobInfo{Key: f.Name, Size: f.Length, ModTime: f.UploadDate.Time()})
+	}
+	return blobs, nil
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Images are small images kept one per document, with the same id as the user or room they belong to
+type Images struct {
+	name       string
+	collection func() *mongo.Collection
+}
+
+var Pfps = &Images{"pfps", func() *mongo.Collection { return db.PfpCollection }}
+var RoomImages = &Images{"roomimages", func() *mongo.Collection { return db.RoomImageCollection }}
+
+type imageDoc struct {
+	Binary  primitive.Binary `bson:"binary"`
+	BlobKey string           `bson:"blob_key"`
+}
+
+// Get the image, mongo.ErrNoDocuments is returned if there isn't one
+func (i *Images) Get(ctx context.Context, id primitive.ObjectID) ([]byte, error) {
+	var doc imageDoc
+	if err := i.collection().FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if doc.BlobKey == "" {
+		return doc.Binary.Data, nil
+	}
+	rc, err := Blobs.Get(ctx, doc.BlobKey, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Check if there is an image, without getting it
+func (i *Images) Exists(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	count, err := i.collection().CountDocuments(ctx, bson.M{"_id": id}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// Point the document at a blob from PutBytes. Works inside a transaction. The key of the blob that was replaced
+// is returned so it can be released once the change is saved for good.
+func (i *Images) Set(ctx context.Context, id primitive.ObjectID, key string) (string, error) {
+	var old imageDoc
+	err := i.collection().FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{
+		"$set":   bson.M{"blob_key": key},
+		"$unset": bson.M{"binary": ""},
+	}, options.FindOneAndUpdate().SetUpsert(true)).Decode(&old)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return "", err
+	}
+	return old.BlobKey, nil
+}
+
+// Upload the image and save it to the document
+func (i *Images) Save(ctx context.Context, id primitive.ObjectID, data []byte) error {
+	key, err := PutBytes(ctx, data)
+	if err != nil {
+		return err
+	}
+	oldKey, err := i.Set(ctx, id, key)
+	if err != nil {
+		Release(ctx, key)
+		return err
+	}
+	Release(ctx, oldKey)
+	return nil
+}
+
+// Delete the document only, works inside a transaction. The key of its blob is returned so the blob can be
+// released once the document is gone for good.
+func (i *Images) Remove(ctx context.Context, id primitive.ObjectID) (string, error) {
+	var old imageDoc
+	err := i.collection().FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&old)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return "", err
+	}
+	return old.BlobKey, nil
+}
+
+// Delete the image and release its blob
+func (i *Images) Delete(ctx context.Context, id primitive.ObjectID) error {
+	key, err := i.Remove(ctx, id)
+	if err != nil {
+		return err
+	}
+	Release(ctx, key)
+	return nil
+}
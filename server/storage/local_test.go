@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	store := &LocalStore{Dir: t.TempDir()}
+	ctx := context.Background()
+
+	key := "blobs/abc123/0001"
+	content := "0123456789"
+	if err := store.Put(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(store.Dir, "blobs", "abc123", "0001")); err != nil || string(data) != content {
+		t.Fatalf("file has %q (%v), want %q", data, err, content)
+	}
+
+	ranges := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "0123456789"},
+		{0, 4, "0123"},
+		{3, 2, "34"},
+		{7, -1, "789"},
+		{8, 100, "89"},
+		{0, 0, ""},
+	}
+	for _, r := range ranges {
+		rc, err := store.Get(ctx, key, r.offset, r.length)
+		if err != nil {
+			t.Fatalf("Get(offset %d, length %d): %v", r.offset, r.length, err)
+		}
+		if got := readAllAndClose(t, rc); got != r.want {
+			t.Errorf("Get(offset %d, length %d) = %q, want %q", r.offset, r.length, got, r.want)
+		}
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, key, 0, -1); err != ErrNotFound {
+		t.Errorf("Get after Delete returned %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing key returned %v", err)
+	}
+}
+
+func TestLocalStorePutWrongSize(t *testing.T) {
+	store := &LocalStore{Dir: t.TempDir()}
+	if err := store.Put(context.Background(), "blobs/short", strings.NewReader("abc"), 10); err == nil {
+		t.Fatal("Put with the wrong size succeeded")
+	}
+	//neither the blob nor the temporary file is left behind
+	entries, err := os.ReadDir(filepath.Join(store.Dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("blobs directory has %d files after a failed Put, want none", len(entries))
+	}
+}
+
+func TestLocalStoreList(t *testing.T) {
+	store := &LocalStore{Dir: t.TempDir()}
+	ctx := context.Background()
+	for _, key := range []string{"blobs/a/1", "blobs/b/2", "pfps/3", "room_images/4"} {
+		if err := store.Put(ctx, key, strings.NewReader(key), int64(len(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//a Put that is still being written
+	if err := os.WriteFile(filepath.Join(store.Dir, "blobs", localTempPrefix+"partial"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"blobs/", []string{"blobs/a/1", "blobs/b/2"}},
+		{"pfps/", []string{"pfps/3"}},
+		{"", []string{"blobs/a/1", "blobs/b/2", "pfps/3", "room_images/4"}},
+		{"missing/", []string{}},
+	}
+	for _, test := range tests {
+		blobs, err := store.List(ctx, test.prefix)
+		if err != nil {
+			t.Fatalf("List(%q): %v", test.prefix, err)
+		}
+		got := []string{}
+		for _, blob := range blobs {
+			got = append(got, blob.Key)
+			if blob.Size != int64(len(blob.Key)) {
+				t.Errorf("%v has size %d, want %d", blob.Key, blob.Size, len(blob.Key))
+			}
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("List(%q) = %v, want %v", test.prefix, got, test.want)
+		}
+	}
+}
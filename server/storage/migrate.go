@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"log"
+
+	"github.com/web-stuff-98/golang-chat-learning-project/db"
+	"github.com/web-stuff-98/golang-chat-learning-project/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Move the pfps, room images and attachments that still have their data in their documents or GridFS chunks into
+// the blob store. Attachments from before GridFS are moved out of the old attachments collection first. This is safe to run while the server is running, a document is only pointed at its new blob
+// if it hasn't changed since it was read. If it has the blob is released again and the document is left for the
+// next run.
+func Migrate(ctx context.Context) error {
+	for _, images := range []*Images{Pfps, RoomImages} {
+		moved, err := images.migrate(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("Moved %d %v to blob storage", moved, images.name)
+	}
+	moved, err := migrateLegacyAttachments(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Moved %d attachments out of the old attachments collection", moved)
+	moved, err = migrateAttachments(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Moved %d attachments to blob storage", moved)
+	return nil
+}
+
+func (i *Images) migrate(ctx context.Context) (int, error) {
+	cursor, err := i.collection().Find(ctx, bson.M{"blob_key": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	moved := 0
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID     primitive.ObjectID `bson:"_id"`
+			Binary primitive.Binary   `bson:"binary"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return moved, err
+		}
+		key, err := PutBytes(ctx, doc.Binary.Data)
+		if err != nil {
+			return moved, err
+		}
+		//matching the binary means an image uploaded in the meantime isn't replaced with the old one
+		res, err := i.collection().UpdateOne(ctx, bson.M{
+			"_id":      doc.ID,
+			"blob_key": bson.M{"$exists": false},
+			"binary":   doc.Binary,
+		}, bson.M{"$set": bson.M{"blob_key": key}, "$unset": bson.M{"binary": ""}})
+		if err != nil || res.MatchedCount == 0 {
+			Release(ctx, key)
+			if err != nil {
+				return moved, err
+			}
+			continue
+		}
+		moved++
+	}
+	return moved, cursor.Err()
+}
+
+func migrateAttachments(ctx context.Context) (int, error) {
+	cursor, err := db.AttachmentCollection.Find(ctx, bson.M{"metadata.blob_key": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	moved := 0
+	for cursor.Next(ctx) {
+		var attachment models.Attachment
+		if err := cursor.Decode(&attachment); err != nil {
+			return moved, err
+		}
+		//streamed from GridFS into the store
+		rc, err := OpenAttachment(ctx, &attachment, 0, -1)
+		if err != nil {
+			return moved, err
+		}
+		key, err := Put(ctx, rc, attachment.Length)
+		rc.Close()
+		if err != nil {
+			return moved, err
+		}
+		res, err := db.AttachmentCollection.UpdateOne(ctx, bson.M{
+			"_id":               attachment.ID,
+			"metadata.blob_key": bson.M{"$exists": false},
+		}, bson.M{"$set": bson.M{"metadata.blob_key": key}})
+		if err != nil || res.MatchedCount == 0 {
+			Release(ctx, key)
+			if err != nil {
+				return moved, err
+			}
+			continue
+		}
+		//the chunks aren't read anymore once the file points at the blob
+		if _, err := db.AttachmentChunkCollection.DeleteMany(ctx, bson.M{"files_id": attachment.ID}); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, cursor.Err()
+}
+
+// Attachments used to be saved as a single document in the attachments collection, with the same id as their
+// message. They're saved again as a normal attachment with the same id, then the old document is deleted.
+func migrateLegacyAttachments(ctx context.Context) (int, error) {
+	cursor, err := db.LegacyAttachmentCollection.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+	moved := 0
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Binary   primitive.Binary   `bson:"binary"`
+			MimeType string             `bson:"attachment_type"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return moved, err
+		}
+		err := db.AttachmentCollection.FindOne(ctx, bson.M{"_id": doc.ID}).Err()
+		if err == mongo.ErrNoDocuments {
+			//the old documents had no filename
+			err = PutAttachment(ctx, doc.ID, doc.ID, "attachment", doc.MimeType, bytes.NewReader(doc.Binary.Data), int64(len(doc.Binary.Data)))
+			//saved by another run in the meantime
+			if mongo.IsDuplicateKeyError(err) {
+				err = nil
+			}
+			if err != nil {
+				return moved, err
+			}
+			moved++
+		} else if err != nil {
+			return moved, err
+		}
+		if _, err := db.LegacyAttachmentCollection.DeleteOne(ctx, bson.M{"_id": doc.ID}); err != nil {
+			return moved, err
+		}
+	}
+	return moved, cursor.Err()
+}
@@ -0,0 +1,374 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testRegion    = "eu-west-2"
+	testBucket    = "chat-blobs"
+)
+
+// fakeS3 is a stand-in for an S3 bucket. It works out the canonical request and signature of every request on
+// its own and rejects the request if they don't match, so the signing in S3Store is checked against a second
+// implementation rather than against itself.
+type fakeS3 struct {
+	t        *testing.T
+	pageSize int
+
+	mu        sync.Mutex
+	objects   map[string][]byte
+	listCalls int
+}
+
+func newFakeS3(t *testing.T, pageSize int) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{t: t, pageSize: pageSize, objects: make(map[string][]byte)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func newTestS3Store(server *httptest.Server, secretKey string) *S3Store {
+	return &S3Store{
+		Endpoint:  server.URL + "/",
+		Region:    testRegion,
+		Bucket:    testBucket,
+		AccessKey: testAccessKey,
+		SecretKey: secretKey,
+		Client:    server.Client(),
+	}
+}
+
+// URI encoding from the signature version 4 docs: everything except unreserved characters is percent encoded
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func sign(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (f *fakeS3) canonicalRequest(r *http.Request, signedHeaders []string) string {
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]string, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, awsURIEncode(k, true)+"="+awsURIEncode(query.Get(k), true))
+	}
+	headers := ""
+	for _, h := range signedHeaders {
+		value := r.Header.Get(h)
+		if h == "host" {
+			value = r.Host
+		}
+		headers += h + ":" + strings.TrimSpace(value) + "\n"
+	}
+	return strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		strings.Join(params, "&"),
+		headers,
+		strings.Join(signedHeaders, ";"),
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+}
+
+func (f *fakeS3) checkSignature(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return errors.New("missing AWS4-HMAC-SHA256 authorization")
+	}
+	fields := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		fields[k] = v
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return fmt.Errorf("bad X-Amz-Date %q", amzDate)
+	}
+	if time.Since(signedAt) > time.Minute || time.Until(signedAt) > time.Minute {
+		return fmt.Errorf("X-Amz-Date %v is not now", amzDate)
+	}
+	scope := amzDate[:8] + "/" + testRegion + "/s3/aws4_request"
+	if fields["Credential"] != testAccessKey+"/"+scope {
+		return fmt.Errorf("credential %q, expected %q", fields["Credential"], testAccessKey+"/"+scope)
+	}
+	if fields["SignedHeaders"] != "host;x-amz-content-sha256;x-amz-date" {
+		return fmt.Errorf("signed headers %q", fields["SignedHeaders"])
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" {
+		return fmt.Errorf("payload hash %q", r.Header.Get("X-Amz-Content-Sha256"))
+	}
+
+	canonical := f.canonicalRequest(r, strings.Split(fields["SignedHeaders"], ";"))
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := sign([]byte("AWS4"+testSecretKey), amzDate[:8])
+	key = sign(key, testRegion)
+	key = sign(key, "s3")
+	key = sign(key, "aws4_request")
+	if expected := hex.EncodeToString(sign(key, stringToSign)); fields["Signature"] != expected {
+		return fmt.Errorf("signature mismatch for canonical request:\n%v", canonical)
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.checkSignature(r); err != nil {
+		f.t.Log(err)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>")
+		return
+	}
+	bucketPrefix := "/" + testBucket + "/"
+	if !strings.HasPrefix(r.URL.Path, bucketPrefix) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<Error><Code>NoSuchBucket</Code></Error>")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, bucketPrefix)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r)
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(data)) != r.ContentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "<Error><Code>NoSuchKey</Code></Error>")
+			return
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			first, last, _ := strings.Cut(strings.TrimPrefix(rng, "bytes="), "-")
+			start, _ := strconv.Atoi(first)
+			end := len(data) - 1
+			if last != "" {
+				end, _ = strconv.Atoi(last)
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ListObjectsV2, pageSize keys at a time. The continuation token is the last key of the previous page.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	f.listCalls++
+	prefix := r.URL.Query().Get("prefix")
+	after := r.URL.Query().Get("continuation-token")
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{key, len(f.objects[key]), "2024-01-02T03:04:05.000Z"})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func readAllAndClose(t *testing.T, rc io.ReadCloser) string {
+	t.Helper()
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestS3StoreRoundTrip(t *testing.T) {
+	fake, server := newFakeS3(t, 1000)
+	store := newTestS3Store(server, testSecretKey)
+	ctx := context.Background()
+
+	//the second key has characters that have to be escaped in the canonical path
+	keys := []string{"blobs/abc123/0001", "attachments/6400 a+b/name (1).txt"}
+	for _, key := range keys {
+		content := "0123456789 " + key
+		if err := store.Put(ctx, key, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+		if got := string(fake.objects[key]); got != content {
+			t.Fatalf("stored %q under %q, want %q", got, key, content)
+		}
+
+		rc, err := store.Get(ctx, key, 0, -1)
+		if err != nil {
+			t.Fatalf("Get(%q): %v", key, err)
+		}
+		if got := readAllAndClose(t, rc); got != content {
+			t.Errorf("Get(%q) = %q, want %q", key, got, content)
+		}
+	}
+
+	ranges := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 4, "0123"},
+		{3, 2, "34"},
+		{7, -1, "789 blobs/abc123/0001"},
+	}
+	for _, r := range ranges {
+		rc, err := store.Get(ctx, keys[0], r.offset, r.length)
+		if err != nil {
+			t.Fatalf("Get(offset %d, length %d): %v", r.offset, r.length, err)
+		}
+		if got := readAllAndClose(t, rc); got != r.want {
+			t.Errorf("Get(offset %d, length %d) = %q, want %q", r.offset, r.length, got, r.want)
+		}
+	}
+
+	//nothing to fetch, so no request is made
+	rc, err := store.Get(ctx, "blobs/missing", 0, 0)
+	if err != nil {
+		t.Fatalf("Get with length 0: %v", err)
+	}
+	if got := readAllAndClose(t, rc); got != "" {
+		t.Errorf("Get with length 0 = %q, want nothing", got)
+	}
+
+	if _, err := store.Get(ctx, "blobs/missing", 0, -1); err != ErrNotFound {
+		t.Errorf("Get of a missing key returned %v, want ErrNotFound", err)
+	}
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			t.Fatalf("Delete(%q): %v", key, err)
+		}
+		if _, err := store.Get(ctx, key, 0, -1); err != ErrNotFound {
+			t.Errorf("Get(%q) after Delete returned %v, want ErrNotFound", key, err)
+		}
+	}
+	if err := store.Delete(ctx, "blobs/missing"); err != nil {
+		t.Errorf("Delete of a missing key returned %v", err)
+	}
+}
+
+func TestS3StoreListPagination(t *testing.T) {
+	fake, server := newFakeS3(t, 2)
+	store := newTestS3Store(server, testSecretKey)
+	ctx := context.Background()
+
+	want := []string{}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("blobs/%02d/x", i)
+		want = append(want, key)
+		if err := store.Put(ctx, key, bytes.NewReader([]byte{byte(i)}), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Put(ctx, "pfps/other", strings.NewReader("pfp"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, err := store.List(ctx, "blobs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, blob := range blobs {
+		got = append(got, blob.Key)
+		if blob.Size != 1 {
+			t.Errorf("%v has size %d, want 1", blob.Key, blob.Size)
+		}
+		if blob.ModTime.IsZero() {
+			t.Errorf("%v has no modification time", blob.Key)
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+	if fake.listCalls != 3 {
+		t.Errorf("List made %d requests, want 3 pages of 2", fake.listCalls)
+	}
+
+	all, err := store.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 6 {
+		t.Errorf("List with no prefix found %d blobs, want 6", len(all))
+	}
+}
+
+func TestS3StoreRejectedSignature(t *testing.T) {
+	_, server := newFakeS3(t, 1000)
+	store := newTestS3Store(server, "not the secret key")
+	err := store.Put(context.Background(), "blobs/a", strings.NewReader("a"), 1)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Put signed with the wrong key returned %v, want a 403 error", err)
+	}
+}
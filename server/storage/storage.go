@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+/*
+Pfps, room images and attachments are kept in a blob store. Their documents stay in MongoDB and point to their
+blob with a blob_key. Documents from before there was a blob store have no blob_key and keep their data in
+MongoDB (the binary field for images, GridFS chunks for attachments), both kinds can be read so the
+migrate-blobs command can move the old ones while the server is running.
+
+Blobs are stored by the hash of their contents, so identical uploads share one blob (see Put and Release).
+
+The store is picked with the BLOB_STORAGE environment variable:
+	mongo (or unset)  a GridFS bucket in the database
+	local             files under BLOB_STORAGE_DIR (default ./blobs)
+	s3                an S3 compatible bucket (AWS, MinIO...), set with S3_ENDPOINT, S3_REGION, S3_BUCKET,
+	                  S3_ACCESS_KEY and S3_SECRET_KEY
+*/
+
+var ErrNotFound = errors.New("Blob not found")
+
+// Store keeps binary blobs by key. Keys look like "blobs/<sha256>/<random id>".
+type Store interface {
+	// write the blob, size must be the exact number of bytes in r
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// read length bytes of the blob starting at offset, or everything after offset if length is negative
+	Get(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error)
+	// delete the blob, deleting a blob that doesn't exist isn't an error
+	Delete(ctx context.Context, key string) error
+	// list the blobs with keys starting with prefix
+	List(ctx context.Context, prefix string) ([]BlobInfo, error)
+}
+
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// the store blobs are written to
+var Blobs Store
+
+// Set up Blobs from the environment variables
+func Setup() error {
+	switch os.Getenv("BLOB_STORAGE") {
+	case "", "mongo":
+		Blobs = &GridFSStore{Bucket: "blob_data"}
+	case "local":
+		dir := os.Getenv("BLOB_STORAGE_DIR")
+		if dir == "" {
+			dir = "./blobs"
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		Blobs = &LocalStore{Dir: dir}
+		log.Println("Using local blob storage in", dir)
+	case "s3":
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		s3 := &S3Store{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    region,
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Client:    &http.Client{},
+		}
+		if s3.Endpoint == "" || s3.Bucket == "" {
+			return errors.New("S3_ENDPOINT and S3_BUCKET must be set to use s3 blob storage")
+		}
+		Blobs = s3
+		log.Println("Using S3 blob storage in bucket", s3.Bucket)
+	default:
+		return fmt.Errorf("unknown BLOB_STORAGE %v", os.Getenv("BLOB_STORAGE"))
+	}
+	return nil
+}
+
+// io.LimitReader that keeps the Close method of what it's reading
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func limitReadCloser(rc io.ReadCloser, length int64) io.ReadCloser {
+	if length < 0 {
+		return rc
+	}
+	return limitedReadCloser{io.LimitReader(rc, length), rc}
+}